@@ -0,0 +1,55 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/mqtt-exporter/pkg/mqtt-exporter"
+)
+
+var (
+	importOptions = mqttExporter.ImportOptions{
+		Format:    "auto",
+		BatchSize: 5000,
+	}
+)
+
+func newImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <file>...",
+		Short: "Imports historic messages into the configured sinks",
+		Long: `Imports historic messages into the configured sinks.
+Reads files with timestamped messages, either JSON lines as written by
+"record" or "mosquitto_sub -F %j", or text lines "<timestamp> <topic>
+<payload>" as written by "mosquitto_sub -F '%I %t %p'". The messages
+are converted with the configuration and the points are written with
+the original timestamps. "-" reads from stdin.
+`,
+		Run:  runImportCmd,
+		Args: cobra.MinimumNArgs(1),
+	}
+
+	cmd.Flags().StringVar(&importOptions.Format, "format", importOptions.Format, "format of the lines: auto, json or text")
+	cmd.Flags().StringVar(&importOptions.TimeFormat, "time-format", importOptions.TimeFormat, "format of the timestamps of text lines: unix, unix_ms, unix_us, unix_ns, rfc3339 or a Go time layout")
+	cmd.Flags().IntVar(&importOptions.BatchSize, "batch-size", importOptions.BatchSize, "number of points after which the sinks are flushed and the progress is reported")
+	cmd.Flags().BoolVarP(&importOptions.DryRun, "dry-run", "n", importOptions.DryRun, "print the points instead of writing them")
+
+	return cmd
+}
+
+func runImportCmd(cmd *cobra.Command, args []string) {
+	load_config()
+	mqttExporter.Import(args, importOptions)
+}
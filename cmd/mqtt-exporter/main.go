@@ -15,7 +15,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
         "io/ioutil"
 	"os"
 
@@ -27,6 +29,7 @@ import (
 
 var (
 	configFile = "config.yaml"
+	watchConfig = false
 )
 
 func read_yaml_config(conffile string) (mqttExporter.ConfigType, error) {
@@ -37,9 +40,13 @@ func read_yaml_config(conffile string) (mqttExporter.ConfigType, error) {
         if err != nil {
                 return config, fmt.Errorf("Cannot read %q: %v", conffile, err)
         }
-        err = yaml.Unmarshal(file, &config)
-        if err != nil {
-                return config, fmt.Errorf("Unmarshal error: %v", err)
+        // Unknown keys are errors, else typos like "topic_path"
+        // are silently ignored
+        decoder := yaml.NewDecoder(bytes.NewReader(file))
+        decoder.KnownFields(true)
+        err = decoder.Decode(&config)
+        if err != nil && err != io.EOF {
+                return config, fmt.Errorf("Unmarshal error: %w", err)
         }
 
         return config, nil
@@ -60,10 +67,20 @@ This daemon listens to MQTT topics and forwards them to InfluxDB.
 
         mqttExporterCmd.Version = mqttExporter.Version
 
-	mqttExporterCmd.Flags().StringVarP(&configFile, "config", "c", configFile, "configuration file")
+	mqttExporterCmd.PersistentFlags().StringVarP(&configFile, "config", "c", configFile, "configuration file")
+
+	mqttExporterCmd.PersistentFlags().BoolVarP(&mqttExporter.Quiet, "quiet", "q", mqttExporter.Quiet, "don't print any informative messages")
+	mqttExporterCmd.PersistentFlags().BoolVarP(&mqttExporter.Verbose, "verbose", "v", mqttExporter.Verbose, "become really verbose in printing messages")
+	mqttExporterCmd.Flags().BoolVarP(&watchConfig, "watch", "w", watchConfig, "reload the configuration file if it changes")
 
-	mqttExporterCmd.Flags().BoolVarP(&mqttExporter.Quiet, "quiet", "q", mqttExporter.Quiet, "don't print any informative messages")
-	mqttExporterCmd.Flags().BoolVarP(&mqttExporter.Verbose, "verbose", "v", mqttExporter.Verbose, "become really verbose in printing messages")
+	mqttExporterCmd.AddCommand(
+		newValidateCmd(),
+		newTestCmd(),
+		newTestMessageCmd(),
+		newRecordCmd(),
+		newReplayCmd(),
+		newImportCmd(),
+	)
 
 	if err := mqttExporterCmd.Execute(); err != nil {
                 os.Exit(1)
@@ -71,29 +88,48 @@ This daemon listens to MQTT topics and forwards them to InfluxDB.
 }
 
 func runMqttExporterCmd(cmd *cobra.Command, args []string) {
-	var err error
+	load_config()
+	mqttExporter.ReloadConfig = read_config
+	if watchConfig {
+		mqttExporter.WatchConfigFile = configFile
+	}
+	mqttExporter.RunServer()
+}
 
+// read_config reads the configuration file and applies the
+// environment variables.
+func read_config() (mqttExporter.ConfigType, error) {
 	if !mqttExporter.Quiet {
 		log.Infof("Read yaml config %q\n", configFile)
 	}
-	mqttExporter.Config, err = read_yaml_config(configFile)
+	config, err := read_yaml_config(configFile)
 	if err != nil {
-		log.Fatalf("Could not load config: %v", err)
-	}
-
-	if mqttExporter.Config.Verbose != nil {
-		mqttExporter.Verbose = *mqttExporter.Config.Verbose
+		return config, err
 	}
 
         mqtt_user := os.Getenv("MQTT_USER")
-        if mqtt_user != "" {
-                mqttExporter.Config.MQTT.User = mqtt_user
+        if mqtt_user != "" && config.MQTT != nil {
+                config.MQTT.User = mqtt_user
         }
 
 	mqtt_password := os.Getenv("MQTT_PASSWORD")
-        if mqtt_password != "" {
-                mqttExporter.Config.MQTT.Password = mqtt_password
+        if mqtt_password != "" && config.MQTT != nil {
+                config.MQTT.Password = mqtt_password
         }
 
-	mqttExporter.RunServer()
+	return config, nil
+}
+
+// load_config reads the configuration file into mqttExporter.Config.
+func load_config() {
+	var err error
+
+	mqttExporter.Config, err = read_config()
+	if err != nil {
+		log.Fatalf("Could not load config: %v", err)
+	}
+
+	if mqttExporter.Config.Verbose != nil {
+		mqttExporter.Verbose = *mqttExporter.Config.Verbose
+	}
 }
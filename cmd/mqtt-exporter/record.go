@@ -0,0 +1,66 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/mqtt-exporter/pkg/mqtt-exporter"
+)
+
+var (
+	replayRealtime = false
+)
+
+func newRecordCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "record <capture.jsonl>",
+		Short: "Records MQTT messages into a capture file",
+		Long: `Records MQTT messages into a capture file.
+Subscribes to the topic paths of the configuration and appends every
+message received as JSON line to the capture file, until the program
+is terminated.
+`,
+		Run:  runRecordCmd,
+		Args: cobra.ExactArgs(1),
+	}
+}
+
+func runRecordCmd(cmd *cobra.Command, args []string) {
+	load_config()
+	mqttExporter.Record(args[0])
+}
+
+func newReplayCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replay <capture.jsonl>",
+		Short: "Replays a capture file into the configured sinks",
+		Long: `Replays a capture file into the configured sinks.
+The messages of the capture file are converted with the configuration
+and written into the sinks with the original receive time. No
+connection to the MQTT broker is made.
+`,
+		Run:  runReplayCmd,
+		Args: cobra.ExactArgs(1),
+	}
+
+	cmd.Flags().BoolVar(&replayRealtime, "realtime", replayRealtime, "replay the messages at the original speed")
+
+	return cmd
+}
+
+func runReplayCmd(cmd *cobra.Command, args []string) {
+	load_config()
+	mqttExporter.Replay(args[0], replayRealtime)
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/mqtt-exporter/pkg/mqtt-exporter"
+)
+
+var (
+	testTopic          = ""
+	testPayload        = ""
+	testPayloadFile    = ""
+	testRetained       = false
+	testUserProperties map[string]string
+)
+
+func newTestMessageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test-message",
+		Short: "Converts a single message with the configuration",
+		Long: `Converts a single message with the configuration.
+Prints the device ID and metric name extracted from the topic, every
+metric which matched or was skipped and why, and the resulting points.
+No connection to the MQTT broker or the database is made.
+`,
+		Run:  runTestMessageCmd,
+		Args: cobra.ExactArgs(0),
+	}
+
+	cmd.Flags().StringVarP(&testTopic, "topic", "t", testTopic, "topic of the message")
+	cmd.Flags().StringVarP(&testPayload, "payload", "p", testPayload, "payload of the message")
+	cmd.Flags().StringVarP(&testPayloadFile, "payload-file", "f", testPayloadFile, "read the payload from file, '-' for stdin")
+	cmd.Flags().BoolVar(&testRetained, "retained", testRetained, "handle the message as retained message")
+	cmd.Flags().StringToStringVar(&testUserProperties, "user-property", nil, "MQTT v5 user property of the message as key=value, can be repeated")
+	cmd.MarkFlagRequired("topic")
+	cmd.MarkFlagsMutuallyExclusive("payload", "payload-file")
+
+	return cmd
+}
+
+func runTestMessageCmd(cmd *cobra.Command, args []string) {
+	var err error
+
+	config, err := read_yaml_config(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+		os.Exit(1)
+	}
+
+	payload := []byte(testPayload)
+	if testPayloadFile == "-" {
+		payload, err = io.ReadAll(os.Stdin)
+	} else if len(testPayloadFile) > 0 {
+		payload, err = os.ReadFile(testPayloadFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read payload: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = mqttExporter.TestMessage(&config, testTopic, payload, testRetained, testUserProperties, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/mqtt-exporter/pkg/mqtt-exporter"
+	"gopkg.in/yaml.v3"
+)
+
+func newTestCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "test <testsuite.yaml>...",
+		Short: "Runs test suites against the configuration",
+		Long: `Runs test suites against the configuration.
+Every test case of the suites is a message with topic and payload and
+the points expected for it. Differences are reported and the exit code
+is non-zero if any case failed. No connection to the MQTT broker or the
+database is made.
+`,
+		Run:  runTestCmd,
+		Args: cobra.MinimumNArgs(1),
+	}
+}
+
+func read_test_suite(file string) (mqttExporter.TestSuite, error) {
+	var suite mqttExporter.TestSuite
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return suite, fmt.Errorf("Cannot read %q: %v", file, err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&suite); err != nil {
+		return suite, fmt.Errorf("Unmarshal error: %w", err)
+	}
+	return suite, nil
+}
+
+func runTestCmd(cmd *cobra.Command, args []string) {
+	config, err := read_yaml_config(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+		os.Exit(1)
+	}
+
+	failed := 0
+	total := 0
+	for _, file := range args {
+		suite, err := read_test_suite(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			os.Exit(1)
+		}
+
+		if !mqttExporter.Quiet {
+			fmt.Printf("=== %s\n", file)
+		}
+		n, err := mqttExporter.RunTestSuite(&config, &suite, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+			os.Exit(1)
+		}
+		failed += n
+		total += len(suite.Cases)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d test cases failed\n", failed, total)
+		os.Exit(1)
+	}
+	if !mqttExporter.Quiet {
+		fmt.Printf("All %d test cases passed\n", total)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thkukuk/mqtt-exporter/pkg/mqtt-exporter"
+	"gopkg.in/yaml.v3"
+)
+
+func newValidateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate",
+		Short: "Validates the configuration file",
+		Long: `Validates the configuration file.
+Reports unknown keys, invalid regular expressions, unknown metric types,
+duplicate metric names and missing sections. No connection to the MQTT
+broker or the database is made.
+`,
+		Run:  runValidateCmd,
+		Args: cobra.ExactArgs(0),
+	}
+}
+
+func runValidateCmd(cmd *cobra.Command, args []string) {
+	var problems []string
+
+	config, err := read_yaml_config(configFile)
+	if err != nil {
+		var typeErr *yaml.TypeError
+
+		// TypeError contains all unknown keys and type
+		// mismatches, the rest of the file was decoded,
+		// so continue to find more problems.
+		if !errors.As(err, &typeErr) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+			os.Exit(1)
+		}
+		problems = append(problems, typeErr.Errors...)
+	}
+
+	for _, err := range mqttExporter.ValidateConfig(&config) {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, p)
+		}
+		os.Exit(1)
+	}
+
+	if !mqttExporter.Quiet {
+		fmt.Printf("%s: OK\n", configFile)
+	}
+}
@@ -0,0 +1,527 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+// A write-ahead queue on local disk. The points are stored in line
+// protocol in segment files, which are deleted after all points are
+// written. The position of the next point to write is stored in the
+// cursor file.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+const (
+	defBufferMaxSize  = "100M"
+	maxSegmentSize    = 4 * 1024 * 1024
+	minSegmentSize    = 64 * 1024
+	segmentSuffix     = ".lp"
+	cursorFile        = "cursor"
+	discardedMaxSize  = "max_size"
+	discardedMaxAge   = "max_age"
+	discardedRejected = "rejected"
+)
+
+// BufferConfig enables the write-ahead queue of a sink. All points
+// are written to disk first and removed after the database accepted
+// them.
+type BufferConfig struct {
+	Directory string `yaml:"directory"`
+	// MaxSize is the maximum size of the queue, e.g. 500M or 2G.
+	// If it is exceeded, the oldest points are discarded.
+	MaxSize string `yaml:"max_size,omitempty"`
+	// MaxAge is the maximum time a point is kept, 0 means forever.
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+}
+
+// parseSize converts a size with an optional K, M or G suffix into
+// bytes.
+func parseSize(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "B"), "i")
+	factor := int64(1)
+	if len(v) > 0 {
+		switch v[len(v)-1] {
+		case 'k', 'K':
+			factor = 1024
+		case 'm', 'M':
+			factor = 1024 * 1024
+		case 'g', 'G':
+			factor = 1024 * 1024 * 1024
+		}
+		if factor > 1 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * factor, nil
+}
+
+type queueSegment struct {
+	seq  int64
+	size int64
+}
+
+type diskQueue struct {
+	// mutex protects the segments and positions, drainMutex
+	// makes sure, that only one writer sends the points to
+	// the database, so that the order is kept.
+	mutex      sync.Mutex
+	drainMutex sync.Mutex
+
+	sink        string
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	segmentSize int64
+
+	// segments are sorted, the last one is the one written to
+	segments   []queueSegment
+	readOffset int64
+	size       int64
+	writer     *os.File
+
+	// the segment is synced to disk at the latest syncInterval
+	// after the first unsynced point, not for every point
+	syncInterval time.Duration
+	syncTimer    *time.Timer
+	dirty        bool
+
+	refs int
+}
+
+// queuePosition is the position after a batch read by peek.
+type queuePosition struct {
+	seq    int64
+	offset int64
+}
+
+var (
+	// queues are shared by sinks using the same directory, this
+	// happens during a reload
+	queues      = make(map[string]*diskQueue)
+	queuesMutex sync.Mutex
+)
+
+func segmentName(dir string, seq int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seq, segmentSuffix))
+}
+
+// openDiskQueue opens the queue in config.Directory, if it is already
+// open, the existing queue is returned. New points are synced to disk
+// within syncInterval.
+func openDiskQueue(sink string, config *BufferConfig, syncInterval time.Duration) (*diskQueue, error) {
+	dir := filepath.Clean(config.Directory)
+
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+
+	if q, ok := queues[dir]; ok {
+		q.refs++
+		return q, nil
+	}
+
+	maxSize, err := parseSize(config.MaxSize)
+	if len(config.MaxSize) == 0 {
+		maxSize, err = parseSize(defBufferMaxSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		sink:         sink,
+		dir:          dir,
+		maxSize:      maxSize,
+		maxAge:       config.MaxAge,
+		segmentSize:  maxSize / 8,
+		syncInterval: syncInterval,
+		refs:         1,
+	}
+	if q.segmentSize > maxSegmentSize {
+		q.segmentSize = maxSegmentSize
+	} else if q.segmentSize < minSegmentSize {
+		q.segmentSize = minSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if err := q.rotate(); err != nil {
+		return nil, err
+	}
+	if q.size > 0 && !Quiet {
+		log.Infof("Buffer %q contains %d bytes of points", dir, q.size)
+	}
+	bufferBytes.WithLabelValues(sink).Set(float64(q.size))
+	queues[dir] = q
+	return q, nil
+}
+
+// load reads the list of segments and the cursor.
+func (q *diskQueue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		q.segments = append(q.segments, queueSegment{seq: seq, size: fi.Size()})
+	}
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].seq < q.segments[j].seq
+	})
+
+	var pos queuePosition
+	if data, err := os.ReadFile(filepath.Join(q.dir, cursorFile)); err == nil {
+		if _, err := fmt.Sscanf(string(data), "%d %d", &pos.seq, &pos.offset); err != nil {
+			log.Warnf("Buffer %q: invalid cursor, starting at the oldest point", q.dir)
+			pos = queuePosition{}
+		}
+	}
+
+	// segments before the cursor are already written
+	for len(q.segments) > 0 && q.segments[0].seq < pos.seq {
+		os.Remove(segmentName(q.dir, q.segments[0].seq))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) > 0 && q.segments[0].seq == pos.seq &&
+		pos.offset <= q.segments[0].size {
+		q.readOffset = pos.offset
+	}
+
+	for _, s := range q.segments {
+		q.size += s.size
+	}
+	q.size -= q.readOffset
+	return nil
+}
+
+// rotate starts a new segment.
+func (q *diskQueue) rotate() error {
+	seq := int64(1)
+	if len(q.segments) > 0 {
+		seq = q.segments[len(q.segments)-1].seq + 1
+	}
+	f, err := os.OpenFile(segmentName(q.dir, seq), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if q.writer != nil {
+		q.syncWriter()
+		q.writer.Close()
+	}
+	q.writer = f
+	q.segments = append(q.segments, queueSegment{seq: seq})
+	// the new segment has to survive a crash of the system, too
+	return syncDir(q.dir)
+}
+
+// sync writes the points of the current segment to disk.
+func (q *diskQueue) sync() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.syncWriter()
+}
+
+// syncWriter is sync, but q.mutex must be held.
+func (q *diskQueue) syncWriter() {
+	if !q.dirty || q.writer == nil {
+		return
+	}
+	q.dirty = false
+	q.syncTimer.Stop()
+	if err := q.writer.Sync(); err != nil {
+		log.Errorf("Buffer %q: cannot sync points: %v", q.dir, err)
+	}
+}
+
+// syncDir makes the creation and renaming of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFileSync is os.WriteFile, but the data is on the disk when
+// it returns.
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// countLines returns the number of points in a segment after offset.
+func (q *diskQueue) countLines(seq int64, offset int64) int {
+	data, err := os.ReadFile(segmentName(q.dir, seq))
+	if err != nil || offset > int64(len(data)) {
+		return 0
+	}
+	return bytes.Count(data[offset:], []byte("\n"))
+}
+
+// dropOldest removes the oldest segment including all points,
+// which were not written yet.
+func (q *diskQueue) dropOldest(reason string) {
+	s := q.segments[0]
+	lost := q.countLines(s.seq, q.readOffset)
+	os.Remove(segmentName(q.dir, s.seq))
+	q.size -= s.size - q.readOffset
+	q.segments = q.segments[1:]
+	q.readOffset = 0
+	if lost > 0 {
+		bufferDiscarded.WithLabelValues(q.sink, reason).Add(float64(lost))
+		log.Warnf("Buffer %q: discarded %d points (%s)", q.dir, lost, reason)
+	}
+}
+
+// append adds line protocol data to the queue.
+func (q *diskQueue) append(data []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.writer == nil {
+		return fmt.Errorf("buffer %q is closed", q.dir)
+	}
+
+	last := &q.segments[len(q.segments)-1]
+	if last.size >= q.segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		last = &q.segments[len(q.segments)-1]
+	}
+	if n, err := q.writer.Write(data); err != nil {
+		// remove the partial line, else the next point would
+		// be appended to it
+		if n > 0 {
+			if terr := q.truncate(last.size); terr != nil {
+				log.Errorf("Buffer %q: cannot remove partial point: %v", q.dir, terr)
+				q.rotate()
+			}
+		}
+		return err
+	}
+	last.size += int64(len(data))
+	q.size += int64(len(data))
+	if !q.dirty {
+		// without sync the points would only survive a restart
+		// of mqtt-exporter, but not a crash of the system. Syncing
+		// every point is too slow, so they are synced in groups.
+		q.dirty = true
+		q.syncTimer = time.AfterFunc(q.syncInterval, q.sync)
+	}
+	for q.size > q.maxSize && len(q.segments) > 1 {
+		q.dropOldest(discardedMaxSize)
+	}
+	bufferBytes.WithLabelValues(q.sink).Set(float64(q.size))
+	return nil
+}
+
+// truncate cuts the current segment back to size.
+func (q *diskQueue) truncate(size int64) error {
+	if err := q.writer.Truncate(size); err != nil {
+		return err
+	}
+	_, err := q.writer.Seek(size, io.SeekStart)
+	return err
+}
+
+// expire removes all segments, which were not modified for maxAge.
+func (q *diskQueue) expire() {
+	if q.maxAge <= 0 {
+		return
+	}
+	for len(q.segments) > 0 {
+		fi, err := os.Stat(segmentName(q.dir, q.segments[0].seq))
+		if err != nil || time.Since(fi.ModTime()) < q.maxAge {
+			return
+		}
+		if len(q.segments) == 1 {
+			// the segment written to got too old
+			if q.segments[0].size == q.readOffset || q.rotate() != nil {
+				return
+			}
+		}
+		q.dropOldest(discardedMaxAge)
+	}
+}
+
+// peek returns up to max points starting at the oldest one and the
+// position after them, which has to be passed to commit after the
+// points were written.
+func (q *diskQueue) peek(max int) ([]string, queuePosition, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// points are only sent after they are on disk
+	q.syncWriter()
+	q.expire()
+	bufferBytes.WithLabelValues(q.sink).Set(float64(q.size))
+
+	for len(q.segments) > 0 {
+		s := q.segments[0]
+		pos := queuePosition{seq: s.seq, offset: q.readOffset}
+		current := len(q.segments) == 1
+
+		if q.readOffset >= s.size {
+			if current {
+				return nil, pos, nil
+			}
+			q.dropOldest("")
+			continue
+		}
+
+		f, err := os.Open(segmentName(q.dir, s.seq))
+		if err != nil {
+			return nil, pos, err
+		}
+		if _, err := f.Seek(q.readOffset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, pos, err
+		}
+		var lines []string
+		r := bufio.NewReader(io.LimitReader(f, s.size-q.readOffset))
+		for len(lines) < max {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				// an incomplete line of a segment
+				// written during a crash
+				break
+			}
+			pos.offset += int64(len(line))
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+		f.Close()
+
+		if len(lines) == 0 {
+			if current {
+				return nil, pos, nil
+			}
+			q.dropOldest("")
+			continue
+		}
+		return lines, pos, nil
+	}
+	return nil, queuePosition{}, nil
+}
+
+// commit removes all points up to pos from the queue.
+func (q *diskQueue) commit(pos queuePosition) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// the segment could have been discarded meanwhile
+	if len(q.segments) == 0 || q.segments[0].seq != pos.seq ||
+		pos.offset <= q.readOffset {
+		return
+	}
+	q.size -= pos.offset - q.readOffset
+	q.readOffset = pos.offset
+	if len(q.segments) > 1 && q.readOffset >= q.segments[0].size {
+		os.Remove(segmentName(q.dir, pos.seq))
+		q.segments = q.segments[1:]
+		q.readOffset = 0
+	}
+	bufferBytes.WithLabelValues(q.sink).Set(float64(q.size))
+
+	// write the cursor atomically and durable
+	tmp := filepath.Join(q.dir, cursorFile+".tmp")
+	cursor := fmt.Sprintf("%d %d\n", q.segments[0].seq, q.readOffset)
+	if err := writeFileSync(tmp, []byte(cursor)); err != nil {
+		log.Errorf("Buffer %q: cannot write cursor: %v", q.dir, err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, cursorFile)); err != nil {
+		log.Errorf("Buffer %q: cannot write cursor: %v", q.dir, err)
+		return
+	}
+	if err := syncDir(q.dir); err != nil {
+		log.Errorf("Buffer %q: cannot write cursor: %v", q.dir, err)
+	}
+}
+
+// discard counts points, which were rejected by the database.
+func (q *diskQueue) discard(lines int) {
+	bufferDiscarded.WithLabelValues(q.sink, discardedRejected).Add(float64(lines))
+}
+
+// pending returns the size of the points not written yet.
+func (q *diskQueue) pending() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size
+}
+
+// close releases the queue, the last user closes the segment file.
+func (q *diskQueue) close() {
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+
+	q.refs--
+	if q.refs > 0 {
+		return
+	}
+	delete(queues, q.dir)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.writer != nil {
+		q.syncWriter()
+		q.writer.Close()
+		q.writer = nil
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestQueue(t *testing.T, config *BufferConfig) *diskQueue {
+	q, err := openDiskQueue("test", config, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func appendLines(t *testing.T, q *diskQueue, from, to int, padding int) {
+	for i := from; i < to; i++ {
+		line := fmt.Sprintf("p%d %s\n", i, strings.Repeat("x", padding))
+		if err := q.append([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readQueue returns the names of all points in the queue and commits
+// them.
+func readQueue(t *testing.T, q *diskQueue) []string {
+	var names []string
+	for {
+		lines, pos, err := q.peek(7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) == 0 {
+			return names
+		}
+		for _, l := range lines {
+			names = append(names, strings.Fields(l)[0])
+		}
+		q.commit(pos)
+	}
+}
+
+func TestDiskQueuePeekCommit(t *testing.T) {
+	config := &BufferConfig{Directory: t.TempDir()}
+	q := openTestQueue(t, config)
+	appendLines(t, q, 0, 5, 0)
+
+	lines, pos, err := q.peek(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(lines, " "); got != "p0  p1 " {
+		t.Fatalf("peek = %q", got)
+	}
+	// without commit, the same points are returned again
+	if again, _, _ := q.peek(2); strings.Join(again, " ") != strings.Join(lines, " ") {
+		t.Fatalf("second peek = %q", again)
+	}
+	q.commit(pos)
+	if q.dirty {
+		t.Errorf("points not synced by peek")
+	}
+	q.close()
+
+	// the remaining points survive a restart
+	q = openTestQueue(t, config)
+	if got := strings.Join(readQueue(t, q), " "); got != "p2 p3 p4" {
+		t.Errorf("points after restart = %q", got)
+	}
+	if q.pending() != 0 {
+		t.Errorf("pending = %d, want 0", q.pending())
+	}
+	q.close()
+
+	q = openTestQueue(t, config)
+	defer q.close()
+	if got := readQueue(t, q); len(got) != 0 {
+		t.Errorf("committed points returned again: %q", got)
+	}
+}
+
+func TestDiskQueueRotation(t *testing.T) {
+	dir := t.TempDir()
+	q := openTestQueue(t, &BufferConfig{Directory: dir, MaxSize: "1M"})
+	defer q.close()
+
+	// 300 points of 1K in segments of 128K
+	appendLines(t, q, 0, 300, 1024)
+	if len(q.segments) != 3 {
+		t.Errorf("%d segments, want 3", len(q.segments))
+	}
+
+	names := readQueue(t, q)
+	if len(names) != 300 {
+		t.Fatalf("%d points, want 300", len(names))
+	}
+	for i, name := range names {
+		if name != fmt.Sprintf("p%d", i) {
+			t.Fatalf("point %d is %s", i, name)
+		}
+	}
+
+	// only the current segment and the cursor are left
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("%d files left, want 2", len(entries))
+	}
+}
+
+func TestDiskQueueMaxSize(t *testing.T) {
+	q := openTestQueue(t, &BufferConfig{Directory: t.TempDir(), MaxSize: "512K"})
+	defer q.close()
+
+	appendLines(t, q, 0, 1000, 1024)
+	if q.pending() > q.maxSize {
+		t.Errorf("pending = %d, larger than max_size %d", q.pending(), q.maxSize)
+	}
+
+	// the oldest points are discarded, the newest are kept in order
+	names := readQueue(t, q)
+	if len(names) == 0 || len(names) == 1000 {
+		t.Fatalf("%d points left", len(names))
+	}
+	first := 1000 - len(names)
+	for i, name := range names {
+		if name != fmt.Sprintf("p%d", first+i) {
+			t.Fatalf("point %d is %s, want p%d", i, name, first+i)
+		}
+	}
+}
+
+func TestDiskQueueMaxAge(t *testing.T) {
+	q := openTestQueue(t, &BufferConfig{Directory: t.TempDir(), MaxAge: time.Hour})
+	defer q.close()
+
+	appendLines(t, q, 0, 3, 0)
+	q.mutex.Lock()
+	q.rotate()
+	q.mutex.Unlock()
+	appendLines(t, q, 3, 5, 0)
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(segmentName(q.dir, q.segments[0].seq), old, old); err != nil {
+		t.Fatal(err)
+	}
+	lines, _, err := q.peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(lines, " "); got != "p3  p4 " {
+		t.Errorf("points = %q, want p3 and p4", got)
+	}
+
+	// the segment written to is expired, too
+	if err := os.Chtimes(segmentName(q.dir, q.segments[0].seq), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if lines, _, _ := q.peek(10); len(lines) != 0 {
+		t.Errorf("expired points returned: %q", lines)
+	}
+	if q.pending() != 0 {
+		t.Errorf("pending = %d, want 0", q.pending())
+	}
+}
+
+// TestDiskQueueRecovery opens queues left behind by a crash.
+func TestDiskQueueRecovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+		want   string
+	}{
+		{"cursor", "1 2\n", "b d"},
+		{"no cursor", "", "a b d"},
+		{"invalid cursor", "garbage", "a b d"},
+		{"cursor after end", "1 100\n", "a b d"},
+		{"cursor of removed segment", "2 0\n", "d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// the last point of the first segment is incomplete
+			os.WriteFile(segmentName(dir, 1), []byte("a\nb\nc"), 0600)
+			os.WriteFile(segmentName(dir, 2), []byte("d\n"), 0600)
+			if len(tt.cursor) > 0 {
+				os.WriteFile(filepath.Join(dir, cursorFile), []byte(tt.cursor), 0600)
+			}
+
+			q := openTestQueue(t, &BufferConfig{Directory: dir})
+			defer q.close()
+			if got := strings.Join(readQueue(t, q), " "); got != tt.want {
+				t.Errorf("points = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskQueueSync(t *testing.T) {
+	q, err := openDiskQueue("test", &BufferConfig{Directory: t.TempDir()}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+
+	appendLines(t, q, 0, 1, 0)
+	q.mutex.Lock()
+	dirty := q.dirty
+	q.mutex.Unlock()
+	if !dirty {
+		t.Fatal("point synced on append")
+	}
+	for i := 0; dirty && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		q.mutex.Lock()
+		dirty = q.dirty
+		q.mutex.Unlock()
+	}
+	if dirty {
+		t.Error("point not synced after the sync interval")
+	}
+
+	// a partial point of a short write is removed again
+	q.mutex.Lock()
+	q.writer.Write([]byte("partial"))
+	if err := q.truncate(q.segments[len(q.segments)-1].size); err != nil {
+		t.Fatal(err)
+	}
+	q.mutex.Unlock()
+	appendLines(t, q, 1, 2, 0)
+	if got := strings.Join(readQueue(t, q), " "); got != "p0 p1" {
+		t.Errorf("points = %q, want p0 p1", got)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+// DeadLetterConfig describes where messages, which could not be
+// converted, are stored. At least one of Topic and File must be set.
+type DeadLetterConfig struct {
+	// Topic is the MQTT topic the entries are published to
+	Topic string `yaml:"topic,omitempty"`
+	QoS   byte   `yaml:"qos,omitempty"`
+	// File is a JSON lines file the entries are appended to
+	File string `yaml:"file,omitempty"`
+	// Reasons limits the entries to these reasons, the default
+	// is invalid_json, path_not_found and conversion_failed
+	Reasons []string `yaml:"reasons,omitempty"`
+}
+
+// deadLetterEntry is a message, which could not be converted. It is
+// a capture file line with additional information, so that the
+// file can be replayed after fixing the configuration.
+type deadLetterEntry struct {
+	capturedMessage
+	Profile string `json:"profile"`
+	Metric  string `json:"metric"`
+	Reason  string `json:"reason"`
+	Error   string `json:"error"`
+}
+
+type deadLetterWriter struct {
+	mutex   sync.Mutex
+	config  DeadLetterConfig
+	reasons map[string]bool
+	client  mqtt.Client
+	file    *os.File
+}
+
+var (
+	deadLetter *deadLetterWriter
+)
+
+// validateDeadLetter checks the dead_letter section, profiles are the
+// compiled profiles of config.
+func validateDeadLetter(config *ConfigType, profiles []*ProfileType) []error {
+	var errs []error
+
+	dl := config.DeadLetter
+	if dl == nil {
+		return nil
+	}
+	if len(dl.Topic) == 0 && len(dl.File) == 0 {
+		errs = append(errs, fmt.Errorf("dead_letter: neither topic nor file specified"))
+	}
+	if dl.QoS > 2 {
+		errs = append(errs, fmt.Errorf("dead_letter: invalid qos %d", dl.QoS))
+	}
+	for _, r := range dl.Reasons {
+		switch r {
+		case dropInvalidJSON, dropPathNotFound, dropConversion:
+		default:
+			errs = append(errs, fmt.Errorf("dead_letter: unknown reason %q, valid are %s, %s and %s",
+				r, dropInvalidJSON, dropPathNotFound, dropConversion))
+		}
+	}
+	if len(dl.Topic) > 0 {
+		if strings.ContainsAny(dl.Topic, "+#") {
+			errs = append(errs, fmt.Errorf("dead_letter: topic %q must not contain wildcards", dl.Topic))
+		}
+		// the entries would be received again
+		for _, p := range profiles {
+			for _, path := range p.TopicPaths {
+				if topicMatches(path, dl.Topic) {
+					errs = append(errs, fmt.Errorf("dead_letter: topic %q is subscribed by profile %q",
+						dl.Topic, p.Name))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// setupDeadLetter opens the dead letter file. client can be nil if
+// there is no connection yet, see setClient.
+func setupDeadLetter(config *DeadLetterConfig, client mqtt.Client) (*deadLetterWriter, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	d := &deadLetterWriter{
+		config:  *config,
+		reasons: make(map[string]bool),
+		client:  client,
+	}
+	if len(config.Reasons) == 0 {
+		d.reasons[dropInvalidJSON] = true
+		d.reasons[dropPathNotFound] = true
+		d.reasons[dropConversion] = true
+	}
+	for _, r := range config.Reasons {
+		d.reasons[r] = true
+	}
+
+	if len(config.File) > 0 {
+		var err error
+
+		d.file, err = os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("dead_letter: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// setClient sets the MQTT client used to publish the entries.
+func (d *deadLetterWriter) setClient(client mqtt.Client) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	d.client = client
+	d.mutex.Unlock()
+}
+
+// write stores the message as dead letter, if the reason is selected.
+func (d *deadLetterWriter) write(profile *ProfileType, msg mqtt.Message, metric *MetricsType, reason string, err error) {
+	if d == nil || !d.reasons[reason] {
+		return
+	}
+
+	entry := deadLetterEntry{
+		capturedMessage: *newCapturedMessage(msg, time.Now()),
+		Profile:         profile.Name,
+		Metric:          metric.Name,
+		Reason:          reason,
+		Error:           err.Error(),
+	}
+	data, jerr := json.Marshal(&entry)
+	if jerr != nil {
+		log.Errorf("dead_letter: %v", jerr)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.file != nil {
+		if _, err := d.file.Write(append(data, '\n')); err != nil {
+			log.Errorf("dead_letter: cannot write to %q: %v", d.config.File, err)
+		}
+	}
+	if len(d.config.Topic) > 0 && d.client != nil {
+		// don't block the message handler
+		token := d.client.Publish(d.config.Topic, d.config.QoS, false, data)
+		go func() {
+			<-token.Done()
+			if token.Error() != nil {
+				log.Errorf("dead_letter: cannot publish to %q: %v",
+					d.config.Topic, token.Error())
+			}
+		}()
+	}
+}
+
+// close closes the dead letter file.
+func (d *deadLetterWriter) close() {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+}
+
+// rejected counts a value, which could not be converted, and stores
+// the message as dead letter.
+func rejected(profile *ProfileType, msg mqtt.Message, metric *MetricsType, reason string, err error) {
+	dropped(profile, reason)
+	deadLetter.write(profile, msg, metric, reason, err)
+}
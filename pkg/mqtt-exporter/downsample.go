@@ -0,0 +1,137 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+const (
+	defDownsampleEvery    = time.Hour
+	defDownsampleFunction = "mean"
+)
+
+// DownsampleConfig describes a second bucket, into which an InfluxDB
+// task writes the aggregated numeric values of the database.
+type DownsampleConfig struct {
+	Bucket      string        `yaml:"bucket"`
+	Retention   time.Duration `yaml:"retention,omitempty"`
+	Description string        `yaml:"description,omitempty"`
+	// Every is the interval of the task and the aggregation window
+	Every time.Duration `yaml:"every,omitempty"`
+	// Function is the aggregate function of the task
+	Function string `yaml:"function,omitempty"`
+	// Task is the name of the task, the default is
+	// "<database>-downsample"
+	Task string `yaml:"task,omitempty"`
+}
+
+// downsampleFunctions are the valid aggregate functions.
+var downsampleFunctions = map[string]bool{
+	"mean":   true,
+	"median": true,
+	"min":    true,
+	"max":    true,
+	"sum":    true,
+	"count":  true,
+	"first":  true,
+	"last":   true,
+}
+
+// fluxDuration formats d as Flux duration literal.
+func fluxDuration(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d.Seconds()))
+}
+
+// downsampleTask returns the name and the Flux script of the task.
+func downsampleTask(config *InfluxDBConfig) (string, string) {
+	ds := config.Downsample
+
+	name := ds.Task
+	if len(name) == 0 {
+		name = config.Database + "-downsample"
+	}
+	every := ds.Every
+	if every <= 0 {
+		every = defDownsampleEvery
+	}
+	function := ds.Function
+	if len(function) == 0 {
+		function = defDownsampleFunction
+	}
+
+	// only numeric values can be aggregated
+	flux := fmt.Sprintf(`import "types"
+
+option task = {name: %s, every: %s}
+
+from(bucket: %s)
+    |> range(start: -task.every)
+    |> filter(fn: (r) => types.isNumeric(v: r._value))
+    |> aggregateWindow(every: task.every, fn: %s)
+    |> to(bucket: %s, org: %s)
+`, strconv.Quote(name), fluxDuration(every), strconv.Quote(config.Database),
+		function, strconv.Quote(ds.Bucket), strconv.Quote(config.Organization))
+
+	return name, flux
+}
+
+// createDownsampling creates the downsampled bucket and the task, if
+// they do not exist. An existing task is not modified.
+func createDownsampling(client influxdb2.Client, config *InfluxDBConfig) error {
+	ds := config.Downsample
+
+	err := createBucket(client, config.Organization, ds.Bucket,
+		ds.Description, ds.Retention, 0)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	name, flux := downsampleTask(config)
+
+	tasks, err := client.TasksAPI().FindTasks(ctx, &api.TaskFilter{
+		Name:    name,
+		OrgName: config.Organization,
+	})
+	if err != nil {
+		return fmt.Errorf("Error finding task %q: %v", name, err)
+	}
+	if len(tasks) > 0 {
+		return nil
+	}
+
+	org, err := client.OrganizationsAPI().FindOrganizationByName(ctx, config.Organization)
+	if err != nil {
+		return fmt.Errorf("Error finding organization %q: %v",
+			config.Organization, err)
+	}
+	if _, err := client.TasksAPI().CreateTaskByFlux(ctx, flux, *org.Id); err != nil {
+		return fmt.Errorf("Error creating task %q: %v", name, err)
+	}
+
+	if !Quiet {
+		log.Infof("Created task %q downsampling %q into %q\n",
+			name, config.Database, ds.Bucket)
+	}
+	return nil
+}
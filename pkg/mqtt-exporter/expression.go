@@ -0,0 +1,342 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+// A small arithmetic expression language for the transform pipeline.
+// Supported are numbers, the operators + - * / % ^, parentheses, the
+// functions abs, ceil, floor, round, sqrt, min, max and pow, and
+// variables. The variable "value" is the current value of the metric,
+// all other variables are selectors into the JSON payload, e.g.
+// "params.voltage" or "params.switch:0.apower".
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	exprValueVariable = "value"
+)
+
+type exprNode interface {
+	eval(lookup func(name string) (float64, error)) (float64, error)
+}
+
+type exprNumber float64
+
+type exprVariable string
+
+type exprUnary struct {
+	op      byte
+	operand exprNode
+}
+
+type exprBinary struct {
+	op          byte
+	left, right exprNode
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+type expression struct {
+	source    string
+	root      exprNode
+	variables []string
+}
+
+var exprFunctions = map[string]struct {
+	args int
+	fn   func(args []float64) float64
+}{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+}
+
+func (n exprNumber) eval(lookup func(string) (float64, error)) (float64, error) {
+	return float64(n), nil
+}
+
+func (n exprVariable) eval(lookup func(string) (float64, error)) (float64, error) {
+	return lookup(string(n))
+}
+
+func (n *exprUnary) eval(lookup func(string) (float64, error)) (float64, error) {
+	v, err := n.operand.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == '-' {
+		return -v, nil
+	}
+	return v, nil
+}
+
+func (n *exprBinary) eval(lookup func(string) (float64, error)) (float64, error) {
+	l, err := n.left.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case '%':
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return math.Mod(l, r), nil
+	case '^':
+		return math.Pow(l, r), nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", n.op)
+}
+
+func (n *exprCall) eval(lookup func(string) (float64, error)) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i := range n.args {
+		var err error
+		if args[i], err = n.args[i].eval(lookup); err != nil {
+			return 0, err
+		}
+	}
+	return exprFunctions[n.name].fn(args), nil
+}
+
+// exprParser is a recursive descent parser for the grammar:
+//
+//   expr    = term { ("+" | "-") term }
+//   term    = unary { ("*" | "/" | "%") unary }
+//   unary   = ("-" | "+") unary | factor
+//   factor  = primary [ "^" unary ]
+//   primary = number | variable | function "(" expr { "," expr } ")" | "(" expr ")"
+type exprParser struct {
+	input     string
+	pos       int
+	variables []string
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseFactor() (exprNode, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == '^' {
+		p.pos++
+		exp, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprBinary{op: '^', left: base, right: exp}, nil
+	}
+	return base, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	op := p.peek()
+	if op == '-' || op == '+' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op: op, operand: operand}, nil
+	}
+	return p.parseFactor()
+}
+
+func isIdentStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '.' || c == ':'
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	c := p.peek()
+
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+		}
+		p.pos++
+		return node, nil
+	case (c >= '0' && c <= '9') || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && strings.IndexByte("0123456789.eE", p.input[p.pos]) >= 0 {
+			// allow the sign of an exponent
+			if (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') && p.pos+1 < len(p.input) &&
+				(p.input[p.pos+1] == '-' || p.input[p.pos+1] == '+') {
+				p.pos++
+			}
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return exprNumber(f), nil
+	case isIdentStart(c):
+		start := p.pos
+		for p.pos < len(p.input) {
+			if p.input[p.pos] == '[' {
+				end := findClosing(p.input, p.pos)
+				if end < 0 {
+					return nil, fmt.Errorf("missing ']' at position %d", p.pos)
+				}
+				p.pos = end + 1
+			} else if isIdentChar(p.input[p.pos]) {
+				p.pos++
+			} else {
+				break
+			}
+		}
+		name := p.input[start:p.pos]
+
+		if p.peek() == '(' {
+			f, ok := exprFunctions[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown function %q", name)
+			}
+			p.pos++
+			var args []exprNode
+			for {
+				arg, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if p.peek() != ',' {
+					break
+				}
+				p.pos++
+			}
+			if p.peek() != ')' {
+				return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+			}
+			p.pos++
+			if len(args) != f.args {
+				return nil, fmt.Errorf("%s() expects %d arguments", name, f.args)
+			}
+			return &exprCall{name: name, args: args}, nil
+		}
+
+		p.variables = append(p.variables, name)
+		return exprVariable(name), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+}
+
+// parseExpression compiles an arithmetic expression.
+func parseExpression(input string) (*expression, error) {
+	p := &exprParser{input: input}
+
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	return &expression{source: input, root: root, variables: p.variables}, nil
+}
+
+// eval calculates the expression, variables are resolved by lookup.
+func (e *expression) eval(lookup func(name string) (float64, error)) (float64, error) {
+	return e.root.eval(lookup)
+}
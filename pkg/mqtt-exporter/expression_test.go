@@ -0,0 +1,168 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestExpressionEval(t *testing.T) {
+	variables := map[string]float64{
+		"value":           10,
+		"params.voltage":  230,
+		"a[0].b":          2,
+		`x["y.z"]`:        4,
+		"switch:0.apower": 5,
+	}
+	lookup := func(name string) (float64, error) {
+		if v, ok := variables[name]; ok {
+			return v, nil
+		}
+		return 0, fmt.Errorf("%q not found", name)
+	}
+
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"42", 42},
+		{"1.5e3", 1500},
+		{"2e-1", 0.2},
+		{".5", 0.5},
+		// precedence and associativity
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"24 / 4 / 2", 3},
+		{"7 % 3 * 2", 2},
+		{"1 + 7 % 3", 2},
+		{"2 ^ 3 ^ 2", 512},
+		{"(2 ^ 3) ^ 2", 64},
+		{"2 * 3 ^ 2", 18},
+		{"-2 ^ 2", -4},
+		{"(-2) ^ 2", 4},
+		{"2 ^ -1", 0.5},
+		{"--3", 3},
+		{"-+3", -3},
+		{"1 - -1", 2},
+		{"2*-3", -6},
+		// functions
+		{"abs(-3)", 3},
+		{"ceil(1.2)", 2},
+		{"floor(-1.2)", -2},
+		{"round(2.5)", 3},
+		{"sqrt(16)", 4},
+		{"min(3, 1 + 1)", 2},
+		{"max(-1, -2)", -1},
+		{"pow(2, 10)", 1024},
+		{"max(min(value, 5), 1) * 2", 10},
+		// variables
+		{"value", 10},
+		{"value * params.voltage / 1000", 2.3},
+		{"a[0].b + 1", 3},
+		{`x["y.z"] * 2`, 8},
+		{"switch:0.apower - 1", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := parseExpression(tt.expr)
+			if err != nil {
+				t.Fatalf("parseExpression(%q): %v", tt.expr, err)
+			}
+			got, err := e.eval(lookup)
+			if err != nil {
+				t.Fatalf("eval(%q): %v", tt.expr, err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("eval(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpressionVariables(t *testing.T) {
+	e, err := parseExpression("value * params.voltage + max(a.b, value)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(e.variables, " "), "value params.voltage a.b value"; got != want {
+		t.Errorf("variables = %q, want %q", got, want)
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", "unexpected end"},
+		{"1 +", "unexpected end"},
+		{"(1 + 2", "missing ')'"},
+		{"1 + 2)", "unexpected ')'"},
+		{"1 2", "unexpected '2'"},
+		{"foo(1)", "unknown function"},
+		{"min(1)", "expects 2 arguments"},
+		{"abs(1, 2)", "expects 1 arguments"},
+		{"max(1, 2", "missing ')'"},
+		{"1..2", "invalid number"},
+		{"a[0", "missing ']'"},
+		{"1 # 2", "unexpected '#'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseExpression(tt.expr)
+			if err == nil {
+				t.Fatalf("parseExpression(%q) succeeded, want error %q", tt.expr, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestExpressionEvalErrors(t *testing.T) {
+	lookup := func(name string) (float64, error) {
+		return 0, fmt.Errorf("%q not found", name)
+	}
+
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"1 / 0", "division by zero"},
+		{"1 % (2 - 2)", "division by zero"},
+		{"1 + missing", `"missing" not found`},
+		{"abs(missing)", `"missing" not found`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := parseExpression(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = e.eval(lookup)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("eval(%q) error = %v, want %q", tt.expr, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+const (
+	importFormatAuto = "auto"
+	importFormatJSON = "json"
+	importFormatText = "text"
+
+	defImportBatchSize = 5000
+
+	// mosquitto_sub -F %I, ISO 8601 without colon in the zone
+	mosquittoTimeLayout = "2006-01-02T15:04:05.999999999-0700"
+)
+
+// ImportOptions controls how Import reads the files and writes the
+// points.
+type ImportOptions struct {
+	// Format is auto, json or text
+	Format string
+	// TimeFormat is the format of the timestamps of text lines,
+	// see TimestampConfig.Format
+	TimeFormat string
+	// BatchSize is the number of points after which the sinks
+	// are flushed and the progress is reported
+	BatchSize int
+	// DryRun converts the messages and prints the points
+	// without writing them
+	DryRun bool
+}
+
+// importLine is a line in JSON format. This is either a capture file
+// line written by record or the output of mosquitto_sub -F %j or %J.
+type importLine struct {
+	Time     string          `json:"time"`
+	Tst      string          `json:"tst"`
+	Topic    string          `json:"topic"`
+	Payload  json.RawMessage `json:"payload"`
+	Encoding string          `json:"encoding"`
+	QoS      byte            `json:"qos"`
+	Retained bool            `json:"retained"`
+	Retain   int             `json:"retain"`
+	// Properties are the MQTT v5 properties written by record
+	Properties *messageProperties `json:"properties"`
+}
+
+// parseImportTime converts the timestamp of an import line.
+func parseImportTime(value string, format string) (time.Time, error) {
+	t, err := parseTimestamp(value, format)
+	if err != nil && len(format) == 0 {
+		if t2, err2 := time.Parse(mosquittoTimeLayout, value); err2 == nil {
+			return t2, nil
+		}
+	}
+	return t, err
+}
+
+// parseJSONLine converts a line in JSON format into a message.
+func parseJSONLine(line []byte) (*message, time.Time, error) {
+	var l importLine
+
+	if err := json.Unmarshal(line, &l); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ts := l.Time
+	if len(ts) == 0 {
+		ts = l.Tst
+	}
+	if len(ts) == 0 {
+		return nil, time.Time{}, fmt.Errorf("no timestamp")
+	}
+	t, err := parseImportTime(ts, "")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// the payload is a string, except mosquitto_sub -F %J
+	// found a JSON payload
+	c := capturedMessage{
+		Topic:      l.Topic,
+		Encoding:   l.Encoding,
+		QoS:        l.QoS,
+		Retained:   l.Retained || l.Retain != 0,
+		Properties: l.Properties,
+	}
+	if len(l.Payload) > 0 && l.Payload[0] == '"' {
+		if err := json.Unmarshal(l.Payload, &c.Payload); err != nil {
+			return nil, time.Time{}, err
+		}
+	} else {
+		c.Payload = string(l.Payload)
+	}
+	msg, err := c.message()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return msg, t, nil
+}
+
+// parseTextLine converts a line "<timestamp> <topic> <payload>" as
+// written by mosquitto_sub -F "%I %t %p" or -F "%U %t %p" into a
+// message. MQTT topics can contain spaces, which this format cannot
+// represent: the topic ends at the first space. If only a topic
+// including spaces is subscribed, the line is rejected as ambiguous.
+func parseTextLine(line []byte, options *ImportOptions, subscribers map[string][]*ProfileType) (*message, time.Time, error) {
+	fields := bytes.SplitN(line, []byte(" "), 3)
+	if len(fields) < 2 {
+		return nil, time.Time{}, fmt.Errorf("expected '<timestamp> <topic> <payload>'")
+	}
+
+	t, err := parseImportTime(string(fields[0]), options.TimeFormat)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	msg := &message{topic: string(fields[1])}
+	if len(fields) == 3 {
+		msg.payload = fields[2]
+		if topic, ok := topicWithSpaces(subscribers, msg.topic, fields[2]); ok {
+			return nil, time.Time{}, fmt.Errorf("topic could be %q or %q, topics with spaces require the JSON format", msg.topic, topic)
+		}
+	}
+	return msg, t, nil
+}
+
+// topicWithSpaces returns the topic consisting of topic and the first
+// words of payload, if this one is subscribed but topic is not.
+func topicWithSpaces(subscribers map[string][]*ProfileType, topic string, payload []byte) (string, bool) {
+	subscribed := func(topic string) bool {
+		for path := range subscribers {
+			if topicMatches(path, topic) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if subscribed(topic) {
+		return "", false
+	}
+	words := bytes.Split(payload, []byte(" "))
+	for i := range words {
+		candidate := topic + " " + string(bytes.Join(words[:i+1], []byte(" ")))
+		if subscribed(candidate) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// importSinks returns the configuration with all sinks, which can
+// store points with historic timestamps. Prometheus only knows the
+// current value and is skipped.
+func importSinks(config *ConfigType) ConfigType {
+	result := *config
+	result.InfluxDB = nil
+	result.Prometheus = nil
+	result.Sinks = nil
+
+	for _, sc := range sinkConfigs(config) {
+		if sc.Prometheus != nil {
+			if !Quiet {
+				log.Infof("Skipping sink %q: prometheus cannot import historic data", sc.Name)
+			}
+			continue
+		}
+		result.Sinks = append(result.Sinks, sc)
+	}
+	return result
+}
+
+type importStats struct {
+	lines  int
+	points int
+	errors int
+}
+
+// importFile converts all lines of r and writes the points.
+func importFile(name string, r io.Reader, options *ImportOptions, stats *importStats) error {
+	subscribers := subscriptions()
+	flushed := stats.points
+
+	scanner := bufio.NewScanner(r)
+	// payloads can be larger than the default 64k
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var msg *message
+		var t time.Time
+		var err error
+
+		text := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+		stats.lines++
+
+		switch options.Format {
+		case importFormatJSON:
+			msg, t, err = parseJSONLine(text)
+		case importFormatText:
+			msg, t, err = parseTextLine(text, options, subscribers)
+		default:
+			if text[0] == '{' {
+				msg, t, err = parseJSONLine(text)
+			} else {
+				msg, t, err = parseTextLine(text, options, subscribers)
+			}
+		}
+		if err != nil {
+			log.Errorf("%s:%d: %v", name, line, err)
+			stats.errors++
+			continue
+		}
+
+		// every profile converts the message only once, even
+		// if several of its topic paths match
+		for _, p := range matchingProfiles(subscribers, msg.Topic()) {
+			points, err := msg2dbentry(p, msg, t, nil)
+			if err != nil {
+				log.Errorf("%s:%d: %v", name, line, err)
+				stats.errors++
+				continue
+			}
+			for _, point := range points {
+				if options.DryRun {
+					fmt.Println(formatPoint(point.Measurement,
+						point.Tags, point.Fields, &point.Time))
+				} else {
+					writePoint(point)
+				}
+				stats.points++
+			}
+		}
+
+		if stats.points-flushed >= options.BatchSize {
+			if !options.DryRun {
+				flushSinks()
+			}
+			flushed = stats.points
+			if !Quiet {
+				log.Infof("%s: %d lines, %d points imported, %d errors",
+					name, stats.lines, stats.points, stats.errors)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Import reads files with timestamped messages, converts them with
+// the configuration and writes the points with the original timestamps
+// into the sinks. "-" reads from stdin.
+func Import(files []string, options ImportOptions) {
+	switch options.Format {
+	case "", importFormatAuto, importFormatJSON, importFormatText:
+	default:
+		log.Fatalf("Unknown format %q, valid are auto, json and text", options.Format)
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defImportBatchSize
+	}
+
+	newProfiles, errs := setupProfiles(&Config)
+	setProfiles(newProfiles)
+	config := importSinks(&Config)
+	if !options.DryRun {
+		errs = append(errs, validateSinks(&config)...)
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		log.Fatal("Invalid configuration!")
+	}
+
+	if !options.DryRun {
+		var err error
+
+		sinks, err = setupSinks(&config, http.NewServeMux())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var stats importStats
+	for _, file := range files {
+		var err error
+
+		if file == "-" {
+			err = importFile("stdin", os.Stdin, &options, &stats)
+		} else {
+			var f *os.File
+
+			f, err = os.Open(file)
+			if err == nil {
+				err = importFile(file, f, &options, &stats)
+				f.Close()
+			}
+		}
+		if err != nil {
+			log.Errorf("Cannot read %q: %v", file, err)
+			stats.errors++
+		}
+	}
+
+	if !options.DryRun {
+		closeSinks()
+	}
+	if !Quiet {
+		log.Infof("Import finished: %d lines, %d points, %d errors",
+			stats.lines, stats.points, stats.errors)
+	}
+	if stats.errors > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,44 +1,314 @@
 package mqttExporter
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	apihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
 	"github.com/influxdata/influxdb-client-go/v2/domain"
 	"github.com/influxdata/influxdb-client-go/v2"
+	lp "github.com/influxdata/line-protocol"
 )
 
 const (
 	defInfluxDBPort = "8086"
+	defInfluxDBdatabase = "my-bucket"
+	defBatchSize = 5000
+	defFlushInterval = time.Second
+	maxDrainBackoff = time.Minute
+	reconnectInterval = 10 * time.Second
 )
 
 type InfluxDBConfig struct {
-	Server       string `yaml:"server"`
-	Port         string `yaml:"port"`
-	Tls          bool `yaml:"tls"`
-	Database     string `yaml:"database"`
-	Organization string `yaml:"organization"`
-	Token        string `yaml:"token,omitempty"`
+	Server           string        `yaml:"server"`
+	Port             string        `yaml:"port"`
+	Tls              bool          `yaml:"tls"`
+	Database         string        `yaml:"database"`
+	Organization     string        `yaml:"organization"`
+	Token            string        `yaml:"token,omitempty"`
+	// Version is 1, 2 or 3. If not set, the v2 API is used and
+	// errors creating the database are ignored.
+	Version          int           `yaml:"version,omitempty"`
+	// Username, Password, RetentionPolicy and Consistency are only
+	// used by InfluxDB v1
+	Username         string        `yaml:"username,omitempty"`
+	Password         string        `yaml:"password,omitempty"`
+	RetentionPolicy  string        `yaml:"retention_policy,omitempty"`
+	Consistency      string        `yaml:"consistency,omitempty"`
+	// Retention, ShardGroupDuration and Description are only used
+	// if the database gets created, 0 means infinite retention and
+	// the default shard group duration of InfluxDB.
+	Retention          time.Duration     `yaml:"retention,omitempty"`
+	ShardGroupDuration time.Duration     `yaml:"shard_group_duration,omitempty"`
+	Description        string            `yaml:"description,omitempty"`
+	Downsample         *DownsampleConfig `yaml:"downsample,omitempty"`
+	BatchSize        uint          `yaml:"batch_size,omitempty"`
+	FlushInterval    time.Duration `yaml:"flush_interval,omitempty"`
+	RetryBufferLimit uint          `yaml:"retry_buffer_limit,omitempty"`
+	MaxRetries       *uint         `yaml:"max_retries,omitempty"`
+	Buffer           *BufferConfig `yaml:"buffer,omitempty"`
+	// TLSConfig contains the CA and client certificate, it
+	// implies tls
+	TLSConfig        *TLSConfig    `yaml:"tls_config,omitempty"`
+	// Proxy is the URL of the HTTP proxy, the default is taken
+	// from HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	Proxy            string        `yaml:"proxy,omitempty"`
+	Timeout          time.Duration `yaml:"timeout,omitempty"`
+	Headers          map[string]string `yaml:"headers,omitempty"`
+	Gzip             bool          `yaml:"gzip,omitempty"`
+	// Precision of the timestamps: s, ms, us or ns
+	Precision        string        `yaml:"precision,omitempty"`
 }
 
-func WriteEntry(client influxdb2.Client, config InfluxDBConfig, measurement string, tag map[string]string, field map[string]interface{}) error {
-	writeAPI := client.WriteAPI(config.Organization, config.Database)
-	// Get errors channel
-	errorsCh := writeAPI.Errors()
-	// Create go proc for reading and logging errors
-	go func() {
-		for err := range errorsCh {
-			log.Errorf("Write error (%s): %s\n", measurement, err.Error())
+// influxDBSink writes the points into an InfluxDB database. Without
+// buffer, the points are written asynchronously by the client and
+// kept in memory for retries. With buffer, they are stored on disk
+// and written by drainLoop.
+type influxDBSink struct {
+	name       string
+	config     *InfluxDBConfig
+	client     influxdb2.Client
+	httpClient *http.Client
+	writeAPI   api.WriteAPI
+
+	buffer      *diskQueue
+	blockingAPI api.WriteAPIBlocking
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func newInfluxDBSink(name string, config *InfluxDBConfig) (*influxDBSink, error) {
+	if len(config.Database) == 0 {
+		config.Database = defInfluxDBdatabase
+	}
+	client, httpClient, err := newInfluxDBClient(name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &influxDBSink{
+		name:       name,
+		config:     config,
+		client:     client,
+		httpClient: httpClient,
+		done:       make(chan struct{}),
+	}
+
+	if config.Buffer != nil {
+		var err error
+
+		s.buffer, err = openDiskQueue(name, config.Buffer, flushInterval(config))
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("Cannot open buffer: %v", err)
+		}
+		s.blockingAPI = client.WriteAPIBlocking(config.Organization, config.Database)
+		s.wg.Add(1)
+		go s.drainLoop()
+	} else {
+		s.writeAPI = client.WriteAPI(config.Organization, config.Database)
+
+		// Create go proc for reading and logging errors, the
+		// channel is closed by client.Close()
+		errorsCh := s.writeAPI.Errors()
+		go func() {
+			for err := range errorsCh {
+				log.Errorf("Write error (%s): %s\n", config.Server, err.Error())
+			}
+		}()
+	}
+
+	// Don't fail if the database is not reachable yet, the points
+	// are kept until it is.
+	if err := checkInfluxDB(client, config); err != nil {
+		log.Warnf("InfluxDB (%s) not reachable, retrying in the background: %v", name, err)
+		s.wg.Add(1)
+		go s.waitForInfluxDB()
+	}
+
+	return s, nil
+}
+
+// waitForInfluxDB checks the database until it is reachable, so that
+// it can be created if needed.
+func (s *influxDBSink) waitForInfluxDB() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(reconnectInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		err := checkInfluxDB(s.client, s.config)
+		if err == nil {
+			if !Quiet {
+				log.Infof("InfluxDB (%s) is reachable", s.name)
+			}
+			return
+		}
+		if Verbose {
+			log.Debugf("InfluxDB (%s) not reachable: %v", s.name, err)
+		}
+	}
+}
+
+// permanentError reports whether the database will never accept the
+// points, so that retrying is useless. Missing authorization or a
+// missing bucket can be fixed, so the points are kept.
+func permanentError(err error) bool {
+	var herr *apihttp.Error
+
+	if !errors.As(err, &herr) {
+		return false
+	}
+	switch herr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge,
+		http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// drain writes all points of the buffer in order. It stops at the
+// first error, the remaining points are kept.
+func (s *influxDBSink) drain() error {
+	s.buffer.drainMutex.Lock()
+	defer s.buffer.drainMutex.Unlock()
+
+	batchSize := int(s.config.BatchSize)
+	if batchSize <= 0 {
+		batchSize = defBatchSize
+	}
+
+	for {
+		lines, pos, err := s.buffer.peek(batchSize)
+		if err != nil || len(lines) == 0 {
+			return err
+		}
+		err = s.blockingAPI.WriteRecord(context.Background(), lines...)
+		if err != nil {
+			if !permanentError(err) {
+				return err
+			}
+			log.Errorf("Write error (%s): %d points rejected: %v", s.name, len(lines), err)
+			s.buffer.discard(len(lines))
+		}
+		s.buffer.commit(pos)
+	}
+}
+
+// flushInterval returns the configured flush_interval or the default.
+func flushInterval(config *InfluxDBConfig) time.Duration {
+	if config.FlushInterval <= 0 {
+		return defFlushInterval
+	}
+	return config.FlushInterval
+}
+
+// drainLoop writes the buffered points every flush_interval. If the
+// database is not reachable, the interval is increased up to
+// maxDrainBackoff.
+func (s *influxDBSink) drainLoop() {
+	defer s.wg.Done()
+
+	interval := flushInterval(s.config)
+	wait := interval
+	failing := false
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(wait):
 		}
-	}()
+		if err := s.drain(); err != nil {
+			if !failing {
+				log.Errorf("Write error (%s): %v, buffering points in %q",
+					s.name, err, s.buffer.dir)
+				failing = true
+			}
+			wait = wait * 2
+			if wait > maxDrainBackoff {
+				wait = maxDrainBackoff
+			}
+			continue
+		}
+		if failing {
+			if !Quiet {
+				log.Infof("Buffer of %s written", s.name)
+			}
+			failing = false
+		}
+		wait = interval
+	}
+}
 
-	p := influxdb2.NewPoint(measurement, tag, field, time.Now())
-	// write asynchronously
-	writeAPI.WritePoint(p)
+// Write queues the point, the points are written asynchronously
+// in batches.
+func (s *influxDBSink) Write(point *Point) error {
+	if s.buffer == nil {
+		p := influxdb2.NewPoint(point.Measurement, point.Tags, point.Fields, point.Time)
+		s.writeAPI.WritePoint(p)
+		return nil
+	}
+
+	t := point.Time
+	if precision, ok := precisions[s.config.Precision]; ok {
+		t = t.Truncate(precision)
+	}
+	p := influxdb2.NewPoint(point.Measurement, point.Tags, point.Fields, t)
+
+	var buf bytes.Buffer
+	e := lp.NewEncoder(&buf)
+	e.SetFieldTypeSupport(lp.UintSupport)
+	e.FailOnFieldErr(true)
+	if _, err := e.Encode(p); err != nil {
+		return err
+	}
+	return s.buffer.append(buf.Bytes())
+}
+
+func (s *influxDBSink) Flush() error {
+	if s.buffer == nil {
+		s.writeAPI.Flush()
+		return nil
+	}
+	// the points are safe on disk, if the database is
+	// not reachable
+	if err := s.drain(); err != nil && Verbose {
+		log.Debugf("Cannot write buffer of %s: %v", s.name, err)
+	}
+	return nil
+}
 
+// Close writes all pending points and closes the connection. Points,
+// which cannot be written, stay in the buffer.
+func (s *influxDBSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	if s.buffer == nil {
+		s.writeAPI.Flush()
+	} else {
+		if err := s.drain(); err != nil {
+			log.Warnf("Cannot write buffer of %s, %d bytes are kept in %q: %v",
+				s.name, s.buffer.pending(), s.buffer.dir, err)
+		}
+		s.buffer.close()
+	}
+	s.client.Close()
+	s.httpClient.CloseIdleConnections()
 	return nil
 }
 
@@ -46,11 +316,27 @@ func createDatabase(client influxdb2.Client, config *InfluxDBConfig) error {
 	if Verbose {
 		log.Debug("Check if the database needs to be created...")
 	}
+
+	err := createBucket(client, config.Organization, config.Database,
+		config.Description, config.Retention, config.ShardGroupDuration)
+	if err != nil {
+		return err
+	}
+	if config.Downsample != nil {
+		return createDownsampling(client, config)
+	}
+	return nil
+}
+
+// createBucket creates the bucket, if it does not exist. An existing
+// bucket is not modified.
+func createBucket(client influxdb2.Client, organization string, name string,
+	description string, retention time.Duration, shardGroupDuration time.Duration) error {
 	ctx := context.Background()
 
-	bucket, err := client.BucketsAPI().FindBucketByName(ctx, config.Database)
+	bucket, err := client.BucketsAPI().FindBucketByName(ctx, name)
 	if Verbose && err != nil {
-		log.Debugf("Error finding bucket %q: %v", config.Database, err)
+		log.Debugf("Error finding bucket %q: %v", name, err)
 	}
 	// so we found the database
 	if bucket != nil {
@@ -58,60 +344,213 @@ func createDatabase(client influxdb2.Client, config *InfluxDBConfig) error {
 	}
 
 	// Get organization that will own new bucket
-	org, err := client.OrganizationsAPI().FindOrganizationByName(ctx, config.Organization)
+	org, err := client.OrganizationsAPI().FindOrganizationByName(ctx, organization)
 	if err != nil {
 		return fmt.Errorf("Error finding organization %q: %v",
-			config.Organization, err)
+			organization, err)
+	}
+
+	// Create the bucket, a retention of 0 keeps the data forever
+	rule := domain.RetentionRule{EverySeconds: int64(retention.Seconds())}
+	if shardGroupDuration > 0 {
+		seconds := int64(shardGroupDuration.Seconds())
+		rule.ShardGroupDurationSeconds = &seconds
 	}
-	// Create  a bucket with 1 day retention policy
-	_, err = client.BucketsAPI().CreateBucketWithName(ctx, org,
-		config.Database, domain.RetentionRule{EverySeconds: 0})
+	bucket = &domain.Bucket{
+		Name:           name,
+		OrgID:          org.Id,
+		RetentionRules: domain.RetentionRules{rule},
+	}
+	if len(description) > 0 {
+		bucket.Description = &description
+	}
+	_, err = client.BucketsAPI().CreateBucket(ctx, bucket)
 	if err != nil {
 		return fmt.Errorf("Error crating bucket %q: %v",
-			config.Database, err)
+			name, err)
 	}
 
 	if !Quiet {
-		log.Infof("Created database %q in organization %q\n", config.Database, config.Organization)
+		log.Infof("Created database %q in organization %q\n", name, organization)
 	}
 	return nil
 }
 
-func ConnectInfluxDB(config *InfluxDBConfig) (influxdb2.Client, error) {
+// influxDBURL returns the base URL of the database.
+func influxDBURL(config *InfluxDBConfig) string {
+	if len(config.Port) == 0 {
+		config.Port = defInfluxDBPort
+	}
+	protocol := "http"
+	if config.Tls || config.TLSConfig != nil {
+	        protocol = "https"
+	}
+	return fmt.Sprintf("%s://%s:%s",
+		protocol, config.Server, config.Port)
+}
+
+// precisions are the valid write precisions.
+var precisions = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// headerTransport adds the configured headers to every request.
+type headerTransport struct {
+	headers map[string]string
+	next    *http.Transport
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.next.RoundTrip(req)
+}
+
+func (t *headerTransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+}
+
+// setupTransport applies the TLS, proxy, timeout and header settings
+// to the HTTP client, config must be valid.
+func setupTransport(httpClient *http.Client, config *InfluxDBConfig) error {
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("unexpected transport %T", httpClient.Transport)
+	}
+
+	if config.TLSConfig != nil {
+		loader, err := newTLSLoader(config.TLSConfig)
+		if err != nil {
+			return fmt.Errorf("tls_config: %v", err)
+		}
+		u, err := url.Parse(influxDBURL(config))
+		if err != nil {
+			return fmt.Errorf("server: %v", err)
+		}
+		transport.TLSClientConfig = loader.dynamicConfig(u.Hostname())
+	}
+	if len(config.Proxy) > 0 {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return fmt.Errorf("proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if config.Timeout > 0 {
+		httpClient.Timeout = config.Timeout
+	}
+	if len(config.Headers) > 0 {
+		httpClient.Transport = &headerTransport{
+			headers: config.Headers,
+			next:    transport,
+		}
+	}
+	return nil
+}
+
+// newInfluxDBClient creates the client without connecting to the
+// database. The HTTP client is returned, too, so that the idle
+// connections can be closed.
+func newInfluxDBClient(name string, config *InfluxDBConfig) (influxdb2.Client, *http.Client, error) {
 
 	token := os.Getenv("INFLUXDB_TOKEN")
         if token != "" {
                 config.Token = token
         }
+	if username := os.Getenv("INFLUXDB_USERNAME"); username != "" {
+		config.Username = username
+	}
+	if password := os.Getenv("INFLUXDB_PASSWORD"); password != "" {
+		config.Password = password
+	}
 
 	// Create a new client using an InfluxDB server base URL and an
 	// authentication token
-	if len(config.Port) == 0 {
-		config.Port = defInfluxDBPort
+	serverUrl := influxDBURL(config)
+	options := influxdb2.DefaultOptions()
+	if config.BatchSize > 0 {
+		options.SetBatchSize(config.BatchSize)
 	}
-	protocol := "http"
-	if config.Tls {
-	        protocol = "https"
+	if config.FlushInterval > 0 {
+		options.SetFlushInterval(uint(config.FlushInterval.Milliseconds()))
 	}
-	serverUrl := fmt.Sprintf("%s://%s:%s",
-		protocol, config.Server, config.Port)
-	client := influxdb2.NewClient(serverUrl, config.Token)
-	defer client.Close()
+	if config.RetryBufferLimit > 0 {
+		options.SetRetryBufferLimit(config.RetryBufferLimit)
+	}
+	if config.MaxRetries != nil {
+		options.SetMaxRetries(*config.MaxRetries)
+	}
+	options.SetUseGZip(config.Gzip)
+	// The buffer always contains nanoseconds, the timestamps are
+	// truncated by Write
+	if p, ok := precisions[config.Precision]; ok && config.Buffer == nil {
+		options.SetPrecision(p)
+	}
+	httpClient := options.HTTPClient()
+	if err := setupTransport(httpClient, config); err != nil {
+		return nil, nil, err
+	}
+	var doer apihttp.Doer = httpClient
+	if config.Version == influxDBVersion1 {
+		doer = &influxDBv1Doer{config: config, client: httpClient}
+	}
+	// count the written points and measure the duration
+	options.HTTPOptions().SetHTTPDoer(&instrumentedDoer{
+		sink:   name,
+		client: doer,
+	})
+	return influxdb2.NewClientWithOptions(serverUrl, config.Token, options), httpClient, nil
+}
 
-	health, err := client.Health(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("Cannot get health status: %v", err)
-	} else if health.Status == domain.HealthCheckStatusFail {
-		return nil, fmt.Errorf("Database not healthy: %v", health)
+// checkInfluxDB checks the health of the database and creates it,
+// if it does not exist. InfluxDB v1 and v3 only provide /ping.
+// InfluxDB v3 creates the database with the first write.
+func checkInfluxDB(client influxdb2.Client, config *InfluxDBConfig) error {
+	var err error
+
+	switch config.Version {
+	case influxDBVersion1, influxDBVersion3:
+		if _, err := client.Ping(context.Background()); err != nil {
+			return fmt.Errorf("Cannot ping database: %v", err)
+		}
+	default:
+		health, err := client.Health(context.Background())
+		if err != nil {
+			return fmt.Errorf("Cannot get health status: %v", err)
+		} else if health.Status == domain.HealthCheckStatusFail {
+			return fmt.Errorf("Database not healthy: %v", health)
+		}
 	}
 
-	err = createDatabase(client, config)
-	if err != nil {
-		log.Warnf("Cannot verify database, maybe InfluxDB v1 is used? Please make sure it exists.")
-		if Verbose {
-			log.Debug(err)
+	switch config.Version {
+	case influxDBVersion1:
+		err = createDatabaseV1(client.Options().HTTPOptions().HTTPDoer(),
+			client.ServerURL(), config)
+		if err != nil {
+			log.Warnf("Cannot verify database %q, please make sure it exists: %v",
+				config.Database, err)
+		}
+	case influxDBVersion2:
+		err = createDatabase(client, config)
+		if err != nil {
+			log.Warnf("Cannot verify bucket %q, please make sure it exists: %v",
+				config.Database, err)
+		}
+	case influxDBVersion3:
+	default:
+		err = createDatabase(client, config)
+		if err != nil {
+			log.Warnf("Cannot verify database, maybe InfluxDB v1 is used? Please make sure it exists.")
+			if Verbose {
+				log.Debug(err)
+			}
 		}
 	}
 
-	return client, nil
+	return nil
 }
@@ -0,0 +1,189 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+// Native InfluxDB v1 support. The points are written with the
+// influxdb2 client, whose write requests are converted into requests
+// of the v1 API, so that batching, retries and the buffer work the
+// same way for all versions.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	apihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+const (
+	influxDBVersion1 = 1
+	influxDBVersion2 = 2
+	influxDBVersion3 = 3
+)
+
+// v1Precision maps the precision of the v2 API to the v1 API.
+var v1Precision = map[string]string{
+	"ns": "n",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+// influxDBv1Doer converts the requests of the influxdb2 client into
+// requests of the InfluxDB v1 API.
+type influxDBv1Doer struct {
+	config *InfluxDBConfig
+	client apihttp.Doer
+}
+
+// v1Credentials returns username and password. For compatibility
+// they are taken from token as "username:password", if not set.
+func v1Credentials(config *InfluxDBConfig) (string, string) {
+	if len(config.Username) == 0 {
+		if user, password, ok := strings.Cut(config.Token, ":"); ok {
+			return user, password
+		}
+	}
+	return config.Username, config.Password
+}
+
+func (d *influxDBv1Doer) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Del("Authorization")
+	if user, password := v1Credentials(d.config); len(user) > 0 {
+		req.SetBasicAuth(user, password)
+	}
+
+	if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/api/v2/write") {
+		q := url.Values{}
+		q.Set("db", d.config.Database)
+		if len(d.config.RetentionPolicy) > 0 {
+			q.Set("rp", d.config.RetentionPolicy)
+		}
+		if p, ok := v1Precision[req.URL.Query().Get("precision")]; ok {
+			q.Set("precision", p)
+		}
+		if len(d.config.Consistency) > 0 {
+			q.Set("consistency", d.config.Consistency)
+		}
+		req.URL.Path = strings.TrimSuffix(req.URL.Path, "/api/v2/write") + "/write"
+		req.URL.RawQuery = q.Encode()
+	}
+	return d.client.Do(req)
+}
+
+// v1Query is the response of the /query endpoint.
+type v1Query struct {
+	Results []struct {
+		Series []struct {
+			Values [][]interface{} `json:"values"`
+		} `json:"series"`
+		Error string `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+// queryV1 executes an InfluxQL statement.
+func queryV1(doer apihttp.Doer, serverUrl string, statement string) (*v1Query, error) {
+	form := url.Values{}
+	form.Set("q", statement)
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost,
+		serverUrl+"/query", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := doer.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result v1Query
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if len(result.Error) > 0 {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	for _, r := range result.Results {
+		if len(r.Error) > 0 {
+			return nil, fmt.Errorf("%s", r.Error)
+		}
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return &result, nil
+}
+
+// quoteIdentifier quotes an InfluxQL identifier.
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// createDatabaseV1 creates the database, if it does not exist.
+func createDatabaseV1(doer apihttp.Doer, serverUrl string, config *InfluxDBConfig) error {
+	if Verbose {
+		log.Debug("Check if the database needs to be created...")
+	}
+
+	result, err := queryV1(doer, serverUrl, "SHOW DATABASES")
+	if err != nil {
+		return fmt.Errorf("Error listing databases: %v", err)
+	}
+	for _, r := range result.Results {
+		for _, s := range r.Series {
+			for _, v := range s.Values {
+				if len(v) > 0 && v[0] == config.Database {
+					return nil
+				}
+			}
+		}
+	}
+
+	statement := "CREATE DATABASE " + quoteIdentifier(config.Database)
+	if config.Retention > 0 || config.ShardGroupDuration > 0 ||
+		len(config.RetentionPolicy) > 0 {
+		statement += " WITH"
+		if config.Retention > 0 {
+			statement += fmt.Sprintf(" DURATION %ds", int64(config.Retention.Seconds()))
+		}
+		if config.ShardGroupDuration > 0 {
+			statement += fmt.Sprintf(" SHARD DURATION %ds", int64(config.ShardGroupDuration.Seconds()))
+		}
+		if len(config.RetentionPolicy) > 0 {
+			statement += " NAME " + quoteIdentifier(config.RetentionPolicy)
+		}
+	}
+	_, err = queryV1(doer, serverUrl, statement)
+	if err != nil {
+		return fmt.Errorf("Error creating database %q: %v", config.Database, err)
+	}
+
+	if !Quiet {
+		log.Infof("Created database %q\n", config.Database)
+	}
+	return nil
+}
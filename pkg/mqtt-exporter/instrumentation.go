@@ -0,0 +1,167 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+// Metrics about the exporter itself. They are registered in the
+// prometheus registry, which is served on the health_check listener
+// and by the prometheus sink.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	apihttp "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	selfNamespace = "mqtt_exporter"
+
+	dropRetained         = "retained"
+	dropExpired          = "expired"
+	dropNoDeviceID       = "no_device_id"
+	dropNoMetricName     = "no_metric_name"
+	dropNoMatchingMetric = "no_matching_metric"
+	dropInvalidJSON      = "invalid_json"
+	dropPathNotFound     = "path_not_found"
+	dropConversion       = "conversion_failed"
+)
+
+var (
+	messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfNamespace,
+		Name:      "messages_received_total",
+		Help:      "Number of MQTT messages received per subscription.",
+	}, []string{"subscription"})
+
+	messagesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfNamespace,
+		Name:      "drops_total",
+		Help:      "Number of messages or values dropped per profile and reason.",
+	}, []string{"profile", "reason"})
+
+	pointsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfNamespace,
+		Name:      "points_written_total",
+		Help:      "Number of points written per sink.",
+	}, []string{"sink"})
+
+	pointsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfNamespace,
+		Name:      "points_failed_total",
+		Help:      "Number of points, which could not be written, per sink. Retries are counted again.",
+	}, []string{"sink"})
+
+	writeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: selfNamespace,
+		Name:      "write_duration_seconds",
+		Help:      "Duration of write requests per sink.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"sink"})
+
+	bufferBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: selfNamespace,
+		Name:      "buffer_bytes",
+		Help:      "Size of the points in the on-disk buffer per sink, which are not written yet.",
+	}, []string{"sink"})
+
+	bufferDiscarded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: selfNamespace,
+		Name:      "buffer_discarded_points_total",
+		Help:      "Number of points removed from the on-disk buffer without being written per sink and reason.",
+	}, []string{"sink", "reason"})
+
+	mqttConnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: selfNamespace,
+		Name:      "mqtt_connects_total",
+		Help:      "Number of successful connections to the MQTT broker.",
+	})
+
+	mqttConnectionsLost = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: selfNamespace,
+		Name:      "mqtt_connections_lost_total",
+		Help:      "Number of lost connections to the MQTT broker.",
+	})
+)
+
+func init() {
+	promRegistry.MustRegister(messagesReceived, messagesDropped,
+		pointsWritten, pointsFailed, writeDuration,
+		bufferBytes, bufferDiscarded,
+		mqttConnects, mqttConnectionsLost)
+}
+
+// dropped counts a message or value dropped by a profile.
+func dropped(profile *ProfileType, reason string) {
+	messagesDropped.WithLabelValues(profile.Name, reason).Inc()
+}
+
+// instrumentedDoer executes the HTTP requests of the InfluxDB client
+// and counts the points of the write requests and their duration.
+type instrumentedDoer struct {
+	sink   string
+	client apihttp.Doer
+}
+
+// countLines returns the number of points of a line protocol body.
+func countLines(body []byte, encoding string) int {
+	if encoding == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return 0
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			return 0
+		}
+	}
+
+	n := 0
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *instrumentedDoer) Do(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, "/write") ||
+		req.Body == nil {
+		return d.client.Do(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	points := float64(countLines(body, req.Header.Get("Content-Encoding")))
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	writeDuration.WithLabelValues(d.sink).Observe(time.Since(start).Seconds())
+
+	if err != nil || resp.StatusCode/100 != 2 {
+		pointsFailed.WithLabelValues(d.sink).Add(points)
+	} else {
+		pointsWritten.WithLabelValues(d.sink).Add(points)
+	}
+	return resp, err
+}
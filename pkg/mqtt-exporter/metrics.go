@@ -16,17 +16,28 @@ package mqttExporter
 
 import (
 	"fmt"
-	"regexp"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
 	"github.com/eclipse/paho.mqtt.golang"
-	"github.com/thedevsaddam/gojsonq/v2"
 )
 
 const (
 	metricPerTopicRegexGroup = "metricname"
+	metricTemplateKey        = "metric"
+	deviceTag                = "device"
+
+	typeFloat   = "float"
+	typeInt     = "int"
+	typeInteger = "integer"
+	typeUint    = "uint"
+	typeBool    = "bool"
+	typeBoolean = "boolean"
+	typeString  = "string"
+	typeJson    = "json"
 )
 
 type MetricsType struct {
@@ -36,43 +47,258 @@ type MetricsType struct {
 	Type               string                    `yaml:"type,omitempty"`
 	ConstantTags       map[string]string         `yaml:"const_tags"`
 	StringValueMapping *StringValueMappingConfig `yaml:"string_value_mapping,omitempty"`
+	Timestamp          *TimestampConfig          `yaml:"timestamp,omitempty"`
+	KeyTag             string                    `yaml:"key_tag,omitempty"`
+	Transform          []TransformConfig         `yaml:"transform,omitempty"`
+	BoolValues         *BoolValuesConfig         `yaml:"bool_values,omitempty"`
+
+	// topicName is the part of MqttName matching the metric name
+	// of the topic, selector the remaining path inside the JSON
+	// struct or nil, if the payload is a single value.
+	topicName string
+	selector  *selector
+	// unit is the unit after the transformation pipeline
+	unit string
+}
+
+// BoolValuesConfig contains the strings, which are interpreted as
+// true and false. The comparison is case insensitive.
+type BoolValuesConfig struct {
+	True  []string `yaml:"true"`
+	False []string `yaml:"false"`
 }
 
+var (
+	defBoolValues = BoolValuesConfig{
+		True:  []string{"true", "on", "1", "yes"},
+		False: []string{"false", "off", "0", "no"},
+	}
+)
+
 type StringValueMappingConfig struct {
         // ErrorValue is used when no mapping is found in Map
         ErrorValue int            `yaml:"error_value"`
         Map        map[string]int `yaml:"map"`
 }
 
-var (
-	metricPerTopicRegex *regexp.Regexp
-)
+// compile splits MqttName into the metric name of the topic and the
+// path inside the JSON struct. If jsonPayload is set, the whole
+// MqttName is the path inside the JSON struct.
+func (m *MetricsType) compile(jsonPayload bool) error {
+	if len(m.Name) == 0 {
+		m.Name = m.MqttName
+	}
+
+	i := strings.IndexAny(m.MqttName, ".[")
+	if jsonPayload {
+		var err error
+
+		if len(m.MqttName) == 0 {
+			return fmt.Errorf("metric %q: no mqtt_name specified", m.Name)
+		}
+		m.topicName = ""
+		m.selector, err = parseSelector(m.MqttName)
+		if err != nil {
+			return fmt.Errorf("metric %q: %v", m.Name, err)
+		}
+	} else if i < 0 {
+		m.topicName = m.MqttName
+		m.selector = nil
+	} else {
+		var err error
 
-// metricPerTopicValue returns the metric name.
-func metricPerTopicValue(topic string) string {
-	if metricPerTopicRegex == nil {
-		return ""
+		m.topicName = m.MqttName[:i]
+		m.selector, err = parseSelector(m.MqttName[i:])
+		if err != nil {
+			return fmt.Errorf("metric %q: %v", m.Name, err)
+		}
+	}
+
+	if m.Timestamp != nil {
+		if err := m.Timestamp.compile(); err != nil {
+			return fmt.Errorf("metric %q: timestamp: %v", m.Name, err)
+		}
+		// without JSON struct there is nothing to look for the path in
+		if len(m.Timestamp.Path) > 0 && m.selector == nil {
+			return fmt.Errorf("metric %q: timestamp: path requires a JSON path in mqtt_name", m.Name)
+		}
+	}
+
+	if err := m.checkType(); err != nil {
+		return fmt.Errorf("metric %q: %v", m.Name, err)
 	}
 
-        match := metricPerTopicRegex.FindStringSubmatch(topic)
-        values := make(map[string]string)
-        for i, name := range metricPerTopicRegex.SubexpNames() {
-                if len(match) > i && name != "" {
-			values[name] = match[i]
-                }
-        }
-        return values[metricPerTopicRegexGroup]
+	m.unit = m.Unit
+	for i := range m.Transform {
+		var err error
+
+		if m.unit, err = m.Transform[i].compile(m.unit); err != nil {
+			return fmt.Errorf("metric %q: transform %d: %v", m.Name, i+1, err)
+		}
+	}
+	return nil
 }
 
-func msg2dbentry(metrics []MetricsType, msg mqtt.Message) (string, map[string]string, map[string]interface{}, error) {
-	deviceID := deviceIDValue(msg.Topic())
+// parseInteger converts a decimal or, with "0x" prefix, hexadecimal
+// number. Floating point numbers without fraction are accepted, too.
+func parseInteger(payload string, unsigned bool) (interface{}, error) {
+	s := strings.TrimSpace(payload)
+	base := 10
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+		base = 16
+	}
+
+	if unsigned {
+		if u, err := strconv.ParseUint(s, base, 64); err == nil {
+			return u, nil
+		}
+	} else if i, err := strconv.ParseInt(s, base, 64); err == nil {
+		return i, nil
+	}
+
+	if base == 10 {
+		if f, err := strconv.ParseFloat(s, 64); err == nil && f == math.Trunc(f) {
+			if unsigned && f >= 0 && f <= math.MaxUint64 {
+				return uint64(f), nil
+			} else if !unsigned && f >= math.MinInt64 && f <= math.MaxInt64 {
+				return int64(f), nil
+			}
+		}
+	}
+
+	if unsigned {
+		return nil, fmt.Errorf("cannot convert '%s' to uint64", payload)
+	}
+	return nil, fmt.Errorf("cannot convert '%s' to int64", payload)
+}
+
+// parseBool converts payload into a boolean. If the metric has no
+// bool_values, the default list is used.
+func parseBool(metric *MetricsType, payload string) (bool, error) {
+	values := metric.BoolValues
+	if values == nil {
+		values = &defBoolValues
+	}
+
+	s := strings.TrimSpace(payload)
+	for _, v := range values.True {
+		if strings.EqualFold(s, v) {
+			return true, nil
+		}
+	}
+	for _, v := range values.False {
+		if strings.EqualFold(s, v) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("cannot convert '%s' to bool", payload)
+}
+
+// convertValue converts the string representation of a value into
+// the type of the metric.
+func convertValue(metric *MetricsType, payload string) (interface{}, error) {
+	if metric.StringValueMapping != nil {
+		v := metric.StringValueMapping.ErrorValue
+		for k := range metric.StringValueMapping.Map {
+			if payload[:] == k {
+				v = metric.StringValueMapping.Map[k]
+			}
+		}
+		return v, nil
+	}
+
+	switch metric.Type {
+	case typeFloat:
+		f, err := strconv.ParseFloat(payload[:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert '%s' to float64: %v",
+				payload, err)
+		}
+		return f, nil
+	case typeInt, typeInteger:
+		return parseInteger(payload, false)
+	case typeUint:
+		return parseInteger(payload, true)
+	case typeBool, typeBoolean:
+		return parseBool(metric, payload)
+	case typeString, typeJson:
+		return payload, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", metric.Type)
+}
+
+// checkType verifies the type of the metric.
+func (m *MetricsType) checkType() error {
+	if m.StringValueMapping != nil {
+		return nil
+	}
+
+	switch m.Type {
+	case typeFloat, typeInt, typeInteger, typeUint:
+		return nil
+	case typeBool, typeBoolean, typeString, typeJson:
+		if len(m.Transform) > 0 {
+			return fmt.Errorf("values of type %q cannot be transformed", m.Type)
+		}
+		return nil
+	case "":
+		return fmt.Errorf("neither type nor string_value_mapping specified")
+	}
+	return fmt.Errorf("unknown type %q, valid are float, int, uint, bool, string and json", m.Type)
+}
+
+// tracer reports the decisions of msg2dbentry, used to debug a
+// configuration. A nil tracer discards everything.
+type tracer func(format string, args ...interface{})
+
+func (t tracer) printf(format string, args ...interface{}) {
+	if t != nil {
+		t(format, args...)
+	}
+}
+
+// msg2dbentry converts the message into points, one point per
+// measurement. The time of the points is taken from the first metric
+// with a timestamp entry, else received is used. If the message does
+// not contain any metric, nil is returned.
+func msg2dbentry(profile *ProfileType, msg mqtt.Message, received time.Time, trace tracer) ([]*Point, error) {
+	if msg.Retained() && profile.Retained == retainedSkip {
+		trace.printf("retained message skipped (retained: %s)", retainedSkip)
+		dropped(profile, dropRetained)
+		return nil, nil // retained message, most likely outdated
+	}
+	properties := messagePropertiesOf(msg)
+	if properties.expired() {
+		trace.printf("expired message skipped (message expiry 0)")
+		dropped(profile, dropExpired)
+		return nil, nil
+	}
+
+	groups := profile.topicGroups(msg.Topic())
+
+	deviceID := groups[deviceIDRegexGroup]
 	if len(deviceID) == 0 {
-		return "", nil, nil, nil // No deviceID, so ignore this message
+		trace.printf("no device ID, topic does not match device_id_regex %q",
+			profile.deviceIDRegex.String())
+		dropped(profile, dropNoDeviceID)
+		return nil, nil // No deviceID, so ignore this message
 	}
+	trace.printf("device ID: %q", deviceID)
 
-	metricName := metricPerTopicValue(msg.Topic())
-	if len(metricName) == 0 {
-		return "", nil, nil, nil // not for us
+	// With json_payload the whole payload is one JSON struct
+	// for all metrics, there is no metric name in the topic.
+	metricName := groups[metricPerTopicRegexGroup]
+	if len(metricName) == 0 && !profile.JsonPayload {
+		trace.printf("no metric name, topic does not match metric_per_topic_regex %q",
+			profile.MetricPerTopicPattern)
+		dropped(profile, dropNoMetricName)
+		return nil, nil // not for us
+	}
+	if profile.JsonPayload {
+		trace.printf("json_payload: whole payload is one JSON struct")
+	} else {
+		trace.printf("metric name: %q", metricName)
 	}
 
 	if Verbose {
@@ -80,93 +306,237 @@ func msg2dbentry(metrics []MetricsType, msg mqtt.Message) (string, map[string]st
 			deviceID, metricName)
 	}
 
-	var tags = make(map[string]string)
-	var field = make(map[string]interface{})
-	var err error
+	// All additional named groups of the regex are stored as tags
+	var topicTags = make(map[string]string)
+	for k, v := range groups {
+		if k != deviceIDRegexGroup && k != metricPerTopicRegexGroup {
+			topicTags[k] = v
+		}
+	}
+	if profile.measurementTmpl != nil {
+		topicTags[deviceTag] = deviceID
+	}
+	if msg.Retained() && profile.Retained == retainedFlag {
+		topicTags[retainedTag] = "true"
+	}
+	// the MQTT v5 user properties and content type are stored
+	// as tags, too
+	for property, tag := range profile.UserPropertyTags {
+		if value, ok := properties.userProperty(property); ok {
+			trace.printf("user property %q: tag %s=%q", property, tag, value)
+			topicTags[tag] = value
+		} else {
+			trace.printf("user property %q not found, no tag %s", property, tag)
+		}
+	}
+	if len(profile.ContentTypeTag) > 0 && properties != nil && len(properties.ContentType) > 0 {
+		trace.printf("content type: tag %s=%q", profile.ContentTypeTag, properties.ContentType)
+		topicTags[profile.ContentTypeTag] = properties.ContentType
+	}
 
+	var points []*Point
+	var pointIndex = make(map[string]*Point)
+	var timestamp time.Time
+	var doc interface{}
+	var docErr error
+	docParsed := false
+	matched := false
+	// a message usually contains only some of the metrics for its
+	// topic, a missing path is only an error if nothing was found
 	found := false
-
-	for i := range metrics {
-		mqttName := metrics[i].MqttName
-		isJson := false
-
-		if strings.Contains(mqttName, ".") {
-			isJson = true
-			mqttName = mqttName[:strings.IndexByte(mqttName, '.')]
+	var notFound *MetricsType
+	// a message is counted and stored as dead letter only once,
+	// even if several of its values are bad
+	isRejected := false
+	reject := func(metric *MetricsType, reason string, err error) {
+		if !isRejected {
+			rejected(profile, msg, metric, reason, err)
+			isRejected = true
 		}
+	}
 
-		if metricName != mqttName {
+	metrics := profile.Metrics
+
+	for i := range metrics {
+		if !profile.JsonPayload && metricName != metrics[i].topicName {
+			trace.printf("metric %q skipped: mqtt_name %q does not match metric name %q",
+				metrics[i].Name, metrics[i].MqttName, metricName)
 			continue
 		}
-		if len(metrics[i].Name) == 0 {
-			metrics[i].Name = metrics[i].MqttName
-		}
+		matched = true
 
-		payload := string(msg.Payload())
-		if isJson {
-			// gojsonq.Find is of form "a.b.c.d", where "a" is
-			// the mqttName. So remove it, it's not part of the
-			// json struct
-			jsonFind := metrics[i].MqttName[(strings.IndexByte(metrics[i].MqttName, '.')+1):]
-			entry := gojsonq.New().FromString(payload).Find(jsonFind)
-			if entry == nil {
+		var values []selectorMatch
+		if metrics[i].selector == nil {
+			values = []selectorMatch{{Value: string(msg.Payload())}}
+		} else {
+			if !docParsed {
+				if properties.jsonContent() {
+					doc, docErr = parseJSON(msg.Payload())
+				} else {
+					docErr = fmt.Errorf("content type %q is no JSON", properties.ContentType)
+				}
+				docParsed = true
+				if docErr != nil {
+					reject(&metrics[i], dropInvalidJSON, docErr)
+				}
+			}
+			if docErr != nil {
+				trace.printf("metric %q skipped: payload is no JSON struct: %v",
+					metrics[i].Name, docErr)
 				if Verbose {
-					log.Warnf("WARNING: %q not found in '%s'!", jsonFind, payload)
+					log.Warnf("WARNING: '%s' is no JSON struct: %v", msg.Payload(), docErr)
 				}
 				continue
 			}
-			payload = fmt.Sprintf("%v", entry)
+			values = metrics[i].selector.find(doc)
+			if len(values) == 0 {
+				trace.printf("metric %q skipped: %q not found in payload",
+					metrics[i].Name, metrics[i].selector.path)
+				if notFound == nil {
+					notFound = &metrics[i]
+				}
+				if Verbose {
+					log.Warnf("WARNING: %q not found in '%s'!",
+						metrics[i].selector.path, msg.Payload())
+				}
+				continue
+			}
+			if len(values) > 1 && !metrics[i].selector.multiple() &&
+				len(metrics[i].KeyTag) == 0 {
+				// a filter should pick a single element, the
+				// field name must not depend on its position
+				if trace != nil {
+					trace.printf("metric %q: %d elements match %q, only the first one is used",
+						metrics[i].Name, len(values), metrics[i].selector.path)
+				} else {
+					log.Warnf("%s: %s: %d elements match %q, only the first one is used",
+						deviceID, metrics[i].Name, len(values), metrics[i].selector.path)
+				}
+				values = values[:1]
+			}
+		}
+		found = true
+
+		measurement, err := profile.measurementName(groups, metrics[i].Name)
+		if err != nil {
+			return nil, err
 		}
 
-		if metrics[i].StringValueMapping != nil {
-			v := metrics[i].StringValueMapping.ErrorValue
-			for k := range metrics[i].StringValueMapping.Map {
-				if payload[:] == k {
-					v = metrics[i].StringValueMapping.Map[k]
+		for _, match := range values {
+			value, err := convertValue(&metrics[i], jsonString(match.Value))
+			if err == nil {
+				value, err = transformValue(&metrics[i], value, doc)
+			}
+			if err != nil {
+				if trace != nil {
+					trace.printf("metric %q: value %s dropped: %v",
+						metrics[i].Name, jsonString(match.Value), err)
+				} else {
+					log.Errorf("%s: %s: %v", deviceID, metrics[i].Name, err)
 				}
+				reject(&metrics[i], dropConversion, err)
+				value = nil
 			}
-			field[metrics[i].Name] = v
-		} else if metrics[i].Type == "float" {
-			var f float64
-			if f, err = strconv.ParseFloat(payload[:], 64); err != nil {
-				log.Errorf("%s: cannot convert '%s' to float64: %v",
-					deviceID, payload, err)
-			} else {
-				field[Config.Metrics[i].Name] = f
+
+			// A selector with wildcards can find several values,
+			// which are stored as own points with the key as tag
+			// or as own fields with the key appended to the name.
+			fieldName := metrics[i].Name
+			pointKey := measurement
+			if len(metrics[i].KeyTag) > 0 {
+				pointKey = fmt.Sprintf("%s\xff%s=%s", measurement,
+					metrics[i].KeyTag, match.Key)
+			} else if metrics[i].selector != nil && metrics[i].selector.multiple() {
+				fieldName = fieldName + "_" + match.Key
 			}
-		} else if metrics[i].Type == "int" || metrics[i].Type == "integer" {
-			var f int64
-			if f, err = strconv.ParseInt(payload[:], 10, 0); err != nil {
-				log.Errorf("%s: cannot convert '%s' to int64: %v",
-					deviceID, payload, err)
-			} else {
-				field[metrics[i].Name] = f
+			// a point has only one unit tag, with split_units
+			// values with different units are stored as own points
+			if profile.SplitUnits {
+				pointKey = pointKey + "\xffunit=" + metrics[i].unit
 			}
-		} else  if metrics[i].Type == "string" {
-			field[metrics[i].Name] = payload
-		}
 
-		for v, k := range metrics[i].ConstantTags {
-			tags[k] = v
-		}
+			point := pointIndex[pointKey]
+			if point == nil {
+				point = &Point{
+					Measurement: measurement,
+					Tags:        make(map[string]string),
+					Fields:      make(map[string]interface{}),
+				}
+				for k, v := range topicTags {
+					point.Tags[k] = v
+				}
+				if len(metrics[i].KeyTag) > 0 {
+					point.Tags[metrics[i].KeyTag] = match.Key
+				}
+				pointIndex[pointKey] = point
+				points = append(points, point)
+			}
+
+			if value != nil {
+				trace.printf("metric %q matched: %s -> field %q = %v (%T)",
+					metrics[i].Name, jsonString(match.Value), fieldName, value, value)
+				point.Fields[fieldName] = value
+			}
 
-		// XXX json structs and unit -> last one wins...
-		if len(metrics[i].Unit) > 0 {
-			tags["unit"] = metrics[i].Unit
+			for k, v := range metrics[i].ConstantTags {
+				point.Tags[k] = v
+			}
+
+			// without split_units the last unit wins
+			if len(metrics[i].unit) > 0 {
+				point.Tags["unit"] = metrics[i].unit
+			}
 		}
 
-		found = true
+		if metrics[i].Timestamp != nil && timestamp.IsZero() {
+			timestamp, err = metrics[i].Timestamp.timestamp(msg, doc)
+			if err != nil {
+				if trace != nil {
+					trace.printf("metric %q: no timestamp: %v", metrics[i].Name, err)
+				} else {
+					log.Errorf("%s: cannot get timestamp of %s: %v",
+						deviceID, metrics[i].Name, err)
+				}
+			} else {
+				trace.printf("metric %q: timestamp %v", metrics[i].Name, timestamp)
+			}
+		}
 
-		if !isJson {
+		if metrics[i].selector == nil {
 			// if this is not a json struct, there cannot
 			// be more entries, so safe time and return
-			return deviceID, tags, field, nil
+			for _, m := range metrics[i+1:] {
+				if m.topicName != metricName {
+					trace.printf("metric %q skipped: mqtt_name %q does not match metric name %q",
+						m.Name, m.MqttName, metricName)
+				} else {
+					trace.printf("metric %q skipped: payload already used by %q",
+						m.Name, metrics[i].Name)
+				}
+			}
+			break
 		}
 	}
 
-	if found {
-		return deviceID, tags, field, nil
-	} else {
-		return "", nil, nil, nil
+	if timestamp.IsZero() {
+		timestamp = received
 	}
+
+	// a point without fields cannot be stored
+	var result []*Point
+	for _, p := range points {
+		if len(p.Fields) > 0 {
+			p.Time = timestamp
+			result = append(result, p)
+		}
+	}
+	if !matched {
+		trace.printf("no metric matched")
+		dropped(profile, dropNoMatchingMetric)
+	} else if !found && notFound != nil {
+		reject(notFound, dropPathNotFound,
+			fmt.Errorf("%q not found, no other metric found either", notFound.selector.path))
+	}
+
+	return result, nil
 }
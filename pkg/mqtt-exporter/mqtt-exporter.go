@@ -15,10 +15,12 @@
 package mqttExporter
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
-	"regexp"
+	"strings"
 	"syscall"
 	"time"
 	"net/http"
@@ -26,7 +28,7 @@ import (
 	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
 	"github.com/thkukuk/mqtt-exporter/pkg/health"
 	"github.com/eclipse/paho.mqtt.golang"
-	"github.com/influxdata/influxdb-client-go/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -35,7 +37,7 @@ const (
 	defMQTTSPort = "8883"
 	defMQTTProtocol = "mqtt"
 	defMQTTSProtocol = "mqtts"
-	defInfluxDBdatabase = "my-bucket"
+	sharePrefix = "$share/"
 )
 
 type ConfigType struct {
@@ -43,7 +45,11 @@ type ConfigType struct {
 	Verbose             *bool           `yaml:"verbose,omitempty"`
 	MQTT                *MQTTConfig     `yaml:"mqtt"`
 	InfluxDB            *InfluxDBConfig `yaml:"influxdb,omitempty"`
+	Prometheus          *PrometheusConfig `yaml:"prometheus,omitempty"`
+	Sinks               []SinkConfig    `yaml:"sinks,omitempty"`
+	DeadLetter          *DeadLetterConfig `yaml:"dead_letter,omitempty"`
 	Metrics             []MetricsType   `yaml:"metrics"`
+	Profiles            []ProfileType   `yaml:"profiles,omitempty"`
 }
 
 type MQTTConfig struct {
@@ -57,6 +63,18 @@ type MQTTConfig struct {
 	ClientID               string `yaml:"client_id"`
 	QoS                    byte   `yaml:"qos"`
 	MetricPerTopicPattern  string `yaml:"metric_per_topic_regex"`
+	Retained               string `yaml:"retained,omitempty"`
+	Measurement            string `yaml:"measurement,omitempty"`
+	JsonPayload            bool   `yaml:"json_payload,omitempty"`
+	TLS                    *TLSConfig `yaml:"tls,omitempty"`
+	// ProtocolVersion is 3 (MQTT 3.1), 4 (MQTT 3.1.1) or 5
+	ProtocolVersion        int    `yaml:"protocol_version,omitempty"`
+	UserPropertyTags       map[string]string `yaml:"user_property_tags,omitempty"`
+	ContentTypeTag         string `yaml:"content_type_tag,omitempty"`
+	SplitUnits             bool   `yaml:"split_units,omitempty"`
+	// SharedGroup subscribes all topic paths as shared subscriptions
+	// "$share/<group>/<topic path>"
+	SharedGroup            string `yaml:"shared_group,omitempty"`
 }
 
 var (
@@ -64,8 +82,6 @@ var (
 	Quiet   = false
 	Verbose = false
 	Config ConfigType
-	db influxdb2.Client
-	deviceIDRegex *regexp.Regexp
 	healthstate = health.NewHealthState()
 )
 
@@ -79,35 +95,77 @@ func createMQTTClientID() string {
         return fmt.Sprintf("%s-%d", host, pid)
 }
 
-// DeviceIDValue returns the device ID.
-func deviceIDValue(topic string) string {
-        match := deviceIDRegex.FindStringSubmatch(topic)
-        values := make(map[string]string)
-        for i, name := range deviceIDRegex.SubexpNames() {
-                if len(match) > i && name != "" {
-			values[name] = match[i]
-                }
-        }
-        return values[deviceIDRegexGroup]
-}
-
-func msgHandler(client mqtt.Client, msg mqtt.Message) {
+func msgHandler(profile *ProfileType, msg mqtt.Message, received time.Time) {
 	if Verbose {
-		log.Debugf("Received message: topic: %s - %s\n", msg.Topic(), msg.Payload())
+		log.Debugf("Received message (%s): topic: %s - %s\n",
+			profile.Name, msg.Topic(), msg.Payload())
 	}
 
-	// XXX error handling
-	id, unit, field, _ := msg2dbentry(Config.Metrics, msg)
+	points, err := msg2dbentry(profile, msg, received, nil)
+	if err != nil {
+		log.Errorf("%s: %v", msg.Topic(), err)
+	}
 
-	if len(id) > 0 {
+	for _, point := range points {
 		if Verbose {
-			log.Debugf("- WriteEntry(%s, %v, %v)", id, unit, field)
+			log.Debugf("- writePoint(%s, %v, %v, %v)", point.Measurement,
+				point.Tags, point.Fields, point.Time)
+		}
+		writePoint(point)
+	}
+}
+
+// subscriptions returns the topic paths of all profiles together
+// with the profiles, which subscribed to them. Several profiles
+// could use the same topic path, so subscribe only once. The map is
+// replaced by setProfiles and must not be modified.
+func subscriptions() map[string][]*ProfileType {
+	return topicSubscribers
+}
+
+// subscriptionQoS returns the highest QoS of the profiles of a
+// subscription.
+func subscriptionQoS(subscribers []*ProfileType) byte {
+	qos := byte(0)
+	for _, p := range subscribers {
+		if p.QoS > qos {
+			qos = p.QoS
+		}
+	}
+	return qos
+}
+
+// newMsgHandler returns a message handler, which forwards the
+// messages of a subscription to all profiles of this subscription.
+// The profiles are looked up for every message, since they can be
+// replaced by a reload of the configuration.
+func newMsgHandler(topic string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		received := time.Now()
+		messagesReceived.WithLabelValues(topic).Inc()
+
+		stateMutex.RLock()
+		defer stateMutex.RUnlock()
+		for _, p := range subscriptions()[topic] {
+			// the client calls the handlers of all matching
+			// topic paths, with overlapping topic paths (like
+			// "a/#" and "a/+/b") a profile uses only the first
+			if p.firstTopicPath(msg.Topic()) != topic {
+				continue
+			}
+			msgHandler(p, msg, received)
 		}
-		_ = WriteEntry(db, *Config.InfluxDB, id, unit, field)
 	}
 }
 
 var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
+	mqttConnects.Inc()
+	subscribe(client, newMsgHandler)
+}
+
+// subscribe subscribes to the topic paths of all profiles, newHandler
+// creates the message handler for a topic path.
+func subscribe(client mqtt.Client, newHandler func(topic string) mqtt.MessageHandler) {
 	log.Info("Connection to MQTT Broker established")
 
 	// Establish the subscription - doing this here means that it
@@ -117,28 +175,49 @@ var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
 	// here would hot cause an issue. However as blocking in other
 	// handlers does cause problems its best to just assume we should
 	// not block
-	for i := range Config.MQTT.TopicPaths {
-		topic := Config.MQTT.TopicPaths[i]
-		token := client.Subscribe(topic, Config.MQTT.QoS, msgHandler)
-
-		go func() {
-			//_ = token.Wait()
-			<-token.Done()
-
-			if token.Error() != nil {
-				log.Errorf("Error subscribing: %s", token.Error())
-			} else {
-				if !Quiet {
-					log.Infof("Subscribed to topic: %s", topic)
-				}
-			}
-		}()
+	stateMutex.RLock()
+	subs := subscriptions()
+	stateMutex.RUnlock()
+
+	for topic, subscribers := range subs {
+		subscribeTopic(client, topic, subscriptionQoS(subscribers), newHandler(topic))
 	}
 	healthstate.IsReady()
 }
 
+// subscriptionTopic returns the topic filter used to subscribe to a
+// topic path. With shared_group this is a shared subscription.
+func subscriptionTopic(topic string) string {
+	if Config.MQTT == nil || len(Config.MQTT.SharedGroup) == 0 ||
+		strings.HasPrefix(topic, sharePrefix) {
+		return topic
+	}
+	return sharePrefix + Config.MQTT.SharedGroup + "/" + topic
+}
+
+// subscribeTopic subscribes to a single topic path without waiting
+// for the result.
+func subscribeTopic(client mqtt.Client, topic string, qos byte, handler mqtt.MessageHandler) {
+	topic = subscriptionTopic(topic)
+	token := client.Subscribe(topic, qos, handler)
+
+	go func() {
+		//_ = token.Wait()
+		<-token.Done()
+
+		if token.Error() != nil {
+			log.Errorf("Error subscribing: %s", token.Error())
+		} else {
+			if !Quiet {
+				log.Infof("Subscribed to topic: %s", topic)
+			}
+		}
+	}()
+}
+
 var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
 	healthstate.NotReady()
+	mqttConnectionsLost.Inc()
 	log.Errorf("Connection to MQTT Broker lost: %v", err)
 }
 
@@ -155,89 +234,118 @@ func RunServer() {
 	signal.Notify(quit, os.Interrupt)
 	signal.Notify(quit, syscall.SIGTERM)
 
+	// SIGHUP is handled after the connection is established
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	go func() {
 		<-quit
 		log.Info("Terminated via Signal. Shutting down...")
 		if mqtt_client != nil && mqtt_client.IsConnectionOpen() {
 			mqtt_client.Disconnect(250)
 		}
+		// write all pending points before exiting
+		stateMutex.Lock()
+		closeSinks()
+		deadLetter.close()
 		os.Exit(0)
 	}()
 
-	if Config.HealthCheckListener != nil &&
-		len(*Config.HealthCheckListener) > 0 {
-		// Start the state server
-		stateServer := &http.Server{
-			Addr:    *Config.HealthCheckListener,
-			Handler: healthstate,
+	if errs := ValidateConfig(&Config); len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
 		}
-		go stateServer.ListenAndServe()
+		log.Fatal("Invalid configuration!")
 	}
 
 	var err error
-	deviceIDRegex, err = regexp.Compile(Config.MQTT.DeviceIDPattern)
+	newProfiles, _ := setupProfiles(&Config)
+	setProfiles(newProfiles)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", healthstate)
+
+	sinks, err = setupSinks(&Config, mux)
 	if err != nil {
 		log.Fatal(err)
 	}
-	var validRegex bool
-        for _, name := range deviceIDRegex.SubexpNames() {
-                if name == deviceIDRegexGroup {
-                        validRegex = true
-                }
-        }
-        if !validRegex {
-		log.Fatalf("device id regex %q does not contain required regex group %q",
-			Config.MQTT.DeviceIDPattern, deviceIDRegexGroup)
-        }
+	deadLetter, err = setupDeadLetter(Config.DeadLetter, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the metrics of the exporter itself
+	if promHealthPath != defPrometheusPath {
+		mux.Handle(defPrometheusPath,
+			promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{}))
+	}
 
-	if len(Config.MQTT.MetricPerTopicPattern) > 0 {
-		metricPerTopicRegex, err = regexp.Compile(Config.MQTT.MetricPerTopicPattern)
-		if err != nil {
-			log.Fatalf("Error compiling metric_per_topic_regex: %v", err)
-		}
-		for _, name := range metricPerTopicRegex.SubexpNames() {
-			if name == metricPerTopicRegexGroup {
-				validRegex = true
-			}
-		}
-		if !validRegex {
-			log.Fatalf("metric_per_topic_regex %q does not contain required regex group %q",
-				Config.MQTT.MetricPerTopicPattern, metricPerTopicRegexGroup)
+	if Config.HealthCheckListener != nil &&
+		len(*Config.HealthCheckListener) > 0 {
+		// Start the state server
+		stateServer := &http.Server{
+			Addr:    *Config.HealthCheckListener,
+			Handler: mux,
 		}
+		go stateServer.ListenAndServe()
 	}
 
-	if Config.InfluxDB != nil {
-		if len(Config.InfluxDB.Database) == 0 {
-			Config.InfluxDB.Database = defInfluxDBdatabase
-		}
-		if Verbose {
-			log.Debug("Try to connect to InfluxDB...")
-		}
-		db, err = ConnectInfluxDB(Config.InfluxDB)
-		if err != nil {
-			log.Fatalf("Cannot connect to InfluxDB: %v", err)
+	opts := mqttClientOptions(connectHandler)
+	mqtt_client = connectMQTT(opts)
+	deadLetter.setClient(mqtt_client)
+
+	trigger := make(chan struct{}, 1)
+	go func() {
+		for range hup {
+			log.Info("Received SIGHUP")
+			triggerReload(trigger)
 		}
-	} else {
-		log.Fatal("No InfluxDB server specified!")
+	}()
+	if len(WatchConfigFile) > 0 {
+		go watchConfig(WatchConfigFile, trigger)
 	}
+	go func() {
+		for range trigger {
+			reload(mqtt_client)
+		}
+	}()
 
-	opts := mqtt.NewClientOptions()
+	errorChan := make(chan error, 1)
+
+	// loop forever and print error messages if they arrive
+	// app is quit with above signal handler "quit".
+	for {
+                select {
+                case err := <-errorChan:
+                        log.Errorf("Error while processing message: %v", err)
+                }
+        }
+}
 
-	if len(Config.MQTT.Protocol) == 0 {
-		if Config.MQTT.Port == defMQTTSPort {
-			Config.MQTT.Protocol = defMQTTSProtocol
+// mqttDefaults sets the protocol and port, if not specified.
+func mqttDefaults(config *MQTTConfig) {
+	if len(config.Protocol) == 0 {
+		if config.Port == defMQTTSPort || config.TLS != nil {
+			config.Protocol = defMQTTSProtocol
 		} else {
-			Config.MQTT.Protocol = defMQTTProtocol
+			config.Protocol = defMQTTProtocol
 		}
 	}
 
-	if len(Config.MQTT.Port) == 0 {
-		if Config.MQTT.Protocol == defMQTTSProtocol {
-			Config.MQTT.Port = defMQTTSPort
+	if len(config.Port) == 0 {
+		if config.Protocol == defMQTTSProtocol {
+			config.Port = defMQTTSPort
 		} else {
-			Config.MQTT.Port = defMQTTPort
+			config.Port = defMQTTPort
 		}
 	}
+}
+
+// mqttClientOptions creates the options for the MQTT client from
+// the configuration, onConnect is called after every (re)connect.
+func mqttClientOptions(onConnect mqtt.OnConnectHandler) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+
+	mqttDefaults(Config.MQTT)
 
 	brokerUrl := fmt.Sprintf("%s://%s:%s",
 		Config.MQTT.Protocol, Config.MQTT.Broker,
@@ -259,27 +367,58 @@ func RunServer() {
 	if len(Config.MQTT.Password) > 0 {
 		opts.SetPassword(Config.MQTT.Password)
 	}
-	opts.OnConnect = connectHandler
+	switch Config.MQTT.ProtocolVersion {
+	case mqttVersion31, mqttVersion311:
+		opts.SetProtocolVersion(uint(Config.MQTT.ProtocolVersion))
+	}
+	if Config.MQTT.TLS != nil {
+		loader, err := newTLSLoader(Config.MQTT.TLS)
+		if err != nil {
+			log.Fatalf("mqtt: tls: %v", err)
+		}
+		if Config.MQTT.ProtocolVersion == mqttVersion5 {
+			// the MQTT v5 client has no hook for every
+			// connection attempt
+			u, err := url.Parse(brokerUrl)
+			if err != nil {
+				log.Fatalf("mqtt: broker: %v", err)
+			}
+			opts.SetTLSConfig(loader.dynamicConfig(u.Hostname()))
+		} else {
+			opts.SetTLSConfig(loader.get())
+			// use renewed certificates for reconnects
+			opts.SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+				return loader.get()
+			})
+		}
+	}
+	opts.OnConnect = onConnect
 	opts.OnConnectionLost = connectLostHandler
 
-        errorChan := make(chan error, 1)
+	return opts
+}
 
-        for {
-		mqtt_client = mqtt.NewClient(opts)
-		if token := mqtt_client.Connect(); token.Wait() && token.Error() != nil {
+// connectMQTT connects to the MQTT broker, if this fails it retries
+// every 10 seconds. With protocol_version 5 the MQTT v5 client is used.
+func connectMQTT(opts *mqtt.ClientOptions) mqtt.Client {
+	var client5 *mqtt5Client
+	if Config.MQTT.ProtocolVersion == mqttVersion5 {
+		// the MQTT v5 client keeps trying to connect on its
+		// own, so the same client is used for all attempts
+		client5 = newMQTT5Client(opts)
+	}
+	for {
+		var client mqtt.Client
+		if client5 != nil {
+			client = client5
+		} else {
+			client = mqtt.NewClient(opts)
+		}
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
 			log.Warnf("Could not connect to mqtt broker, sleep 10 second: %v", token.Error())
 			time.Sleep(10 * time.Second)
 		} else {
-                        break
-                }
-        }
-
-	// loop forever and print error messages if they arrive
-	// app is quit with above signal handler "quit".
-	for {
-                select {
-                case err := <-errorChan:
-                        log.Errorf("Error while processing message: %v", err)
-                }
-        }
+			return client
+		}
+	}
 }
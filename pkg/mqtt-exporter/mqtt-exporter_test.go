@@ -0,0 +1,86 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"testing"
+)
+
+// countingSink counts the points written per measurement.
+type countingSink struct {
+	points map[string]int
+}
+
+func (s *countingSink) Write(p *Point) error {
+	s.points[p.Measurement]++
+	return nil
+}
+
+func (s *countingSink) Flush() error { return nil }
+func (s *countingSink) Close() error { return nil }
+
+// TestMsgHandlerOverlappingPaths passes every message to the handlers
+// of all matching topic paths like the MQTT client does. Every profile
+// must convert it only once.
+func TestMsgHandlerOverlappingPaths(t *testing.T) {
+	newProfiles := []*ProfileType{
+		{Name: "overlapping", TopicPaths: []string{"a/#", "a/+/b"}, JsonPayload: true,
+			DeviceIDPattern: "a/(?P<deviceid>.*)",
+			Measurement:     "overlapping",
+			Metrics:         []MetricsType{{MqttName: "v", Name: "v", Type: "float"}}},
+		{Name: "other", TopicPaths: []string{"a/+/b"}, JsonPayload: true,
+			DeviceIDPattern: "a/(?P<deviceid>.*)",
+			Measurement:     "other",
+			Metrics:         []MetricsType{{MqttName: "v", Name: "v", Type: "float"}}},
+	}
+	for _, p := range newProfiles {
+		if errs := p.compile(); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+	}
+
+	sink := &countingSink{points: make(map[string]int)}
+	oldSinks := sinks
+	sinks = []namedSink{{name: "test", Sink: sink}}
+	defer func() { sinks = oldSinks }()
+	setProfiles(newProfiles)
+	defer setProfiles(nil)
+
+	tests := []struct {
+		topic       string
+		overlapping int
+		other       int
+	}{
+		{"a/x/b", 1, 1},
+		{"a/x", 1, 0},
+		{"a/x/b/c", 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			sink.points = make(map[string]int)
+			msg := &message{topic: tt.topic, payload: []byte(`{"v": 1}`)}
+			for path := range subscriptions() {
+				if topicMatches(path, tt.topic) {
+					newMsgHandler(path)(nil, msg)
+				}
+			}
+			if sink.points["overlapping"] != tt.overlapping || sink.points["other"] != tt.other {
+				t.Errorf("points = %v, want overlapping: %d, other: %d",
+					sink.points, tt.overlapping, tt.other)
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+// MQTT v5 support. paho.mqtt.golang only speaks MQTT 3.1 and 3.1.1,
+// so for MQTT v5 the client of paho.golang is wrapped into the
+// mqtt.Client interface. This way subscriptions, reload and the dead
+// letter output work the same for all protocol versions.
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.mqtt.golang"
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+const (
+	mqttVersion31  = 3
+	mqttVersion311 = 4
+	mqttVersion5   = 5
+
+	// mqtt5Timeout is the timeout of subscribe, unsubscribe and
+	// publish requests
+	mqtt5Timeout = 30 * time.Second
+)
+
+// messageProperties are the MQTT v5 properties of a message, which
+// are available for the conversion. MQTT 3.1.1 messages have none.
+type messageProperties struct {
+	ContentType string `json:"content_type,omitempty"`
+	// MessageExpiry is the remaining lifetime in seconds
+	MessageExpiry *uint32 `json:"message_expiry,omitempty"`
+	// UserProperties can contain the same key several times
+	UserProperties []userProperty `json:"user_properties,omitempty"`
+}
+
+type userProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// userProperty returns the value of the first user property named
+// key.
+func (p *messageProperties) userProperty(key string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	for _, u := range p.UserProperties {
+		if u.Key == key {
+			return u.Value, true
+		}
+	}
+	return "", false
+}
+
+// expired reports whether the message expiry interval has elapsed.
+// The broker sends the remaining lifetime, 0 means the message expired
+// while it was delivered.
+func (p *messageProperties) expired() bool {
+	return p != nil && p.MessageExpiry != nil && *p.MessageExpiry == 0
+}
+
+// jsonContent reports whether the payload can be JSON according to the
+// content type. Messages without content type could be anything.
+func (p *messageProperties) jsonContent() bool {
+	if p == nil || len(p.ContentType) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(p.ContentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+// newMessageProperties converts the properties of a received message,
+// nil is returned if there are none.
+func newMessageProperties(props *paho.PublishProperties) *messageProperties {
+	if props == nil ||
+		(len(props.ContentType) == 0 && props.MessageExpiry == nil && len(props.User) == 0) {
+		return nil
+	}
+	p := &messageProperties{
+		ContentType:   props.ContentType,
+		MessageExpiry: props.MessageExpiry,
+	}
+	for _, u := range props.User {
+		p.UserProperties = append(p.UserProperties, userProperty{Key: u.Key, Value: u.Value})
+	}
+	return p
+}
+
+// userPropertiesFromMap creates the properties of a test message,
+// the keys are sorted so that the result is reproducible.
+func userPropertiesFromMap(m map[string]string) *messageProperties {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	p := &messageProperties{}
+	for _, k := range keys {
+		p.UserProperties = append(p.UserProperties, userProperty{Key: k, Value: m[k]})
+	}
+	return p
+}
+
+// messagePropertiesOf returns the MQTT v5 properties of msg.
+func messagePropertiesOf(msg mqtt.Message) *messageProperties {
+	if m, ok := msg.(*message); ok {
+		return m.properties
+	}
+	return nil
+}
+
+// mqtt5Token is the mqtt.Token of a request of the MQTT v5 client.
+type mqtt5Token struct {
+	done chan struct{}
+	err  error
+}
+
+// runToken executes f in a goroutine, the token is done when f
+// returns.
+func runToken(f func() error) *mqtt5Token {
+	t := &mqtt5Token{done: make(chan struct{})}
+	go func() {
+		t.err = f()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *mqtt5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *mqtt5Token) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (t *mqtt5Token) Done() <-chan struct{} { return t.done }
+
+func (t *mqtt5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// mqtt5Subscription is a topic filter together with its message
+// handler and subscription identifier.
+type mqtt5Subscription struct {
+	id      int
+	topic   string
+	handler mqtt.MessageHandler
+}
+
+// mqtt5Client implements mqtt.Client with autopaho. Every topic filter
+// gets its own subscription identifier, so that the broker tells for
+// which subscription a message is and the handler can be called
+// directly.
+type mqtt5Client struct {
+	mutex     sync.Mutex
+	options   *mqtt.ClientOptions
+	manager   *autopaho.ConnectionManager
+	connected bool
+	// subIDs is set if the broker supports subscription identifiers
+	subIDs bool
+	// connectErr is the error of the last connection attempt
+	connectErr    error
+	subscriptions map[string]*mqtt5Subscription
+	byID          map[int]*mqtt5Subscription
+	nextID        int
+	// overlapping is set if a topic could match several filters,
+	// in this case messages are routed by their topic
+	overlapping bool
+}
+
+// newMQTT5Client creates a MQTT v5 client with the settings of opts.
+func newMQTT5Client(opts *mqtt.ClientOptions) *mqtt5Client {
+	return &mqtt5Client{
+		options:       opts,
+		subscriptions: make(map[string]*mqtt5Subscription),
+		byID:          make(map[int]*mqtt5Subscription),
+	}
+}
+
+// clientConfig converts the options into the autopaho configuration.
+func (c *mqtt5Client) clientConfig() autopaho.ClientConfig {
+	return autopaho.ClientConfig{
+		ServerUrls: c.options.Servers,
+		TlsCfg:     c.options.TLSConfig,
+		KeepAlive:  uint16(c.options.KeepAlive),
+		// like the clean session of MQTT 3.1.1, the
+		// subscriptions are made by the connect handler
+		CleanStartOnInitialConnection: true,
+		ConnectRetryDelay:             10 * time.Second,
+		ConnectTimeout:                c.options.ConnectTimeout,
+		ConnectUsername:               c.options.Username,
+		ConnectPassword:               []byte(c.options.Password),
+		OnConnectionUp:                c.connectionUp,
+		OnConnectError:                c.connectError,
+		ClientConfig: paho.ClientConfig{
+			ClientID: c.options.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				c.received,
+			},
+			OnClientError: c.connectionLost,
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.connectionLost(fmt.Errorf("server requested disconnect (reason: %d)", d.ReasonCode))
+			},
+		},
+	}
+}
+
+func (c *mqtt5Client) connectionUp(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+	c.mutex.Lock()
+	c.connected = true
+	c.connectErr = nil
+	c.subIDs = connack.Properties == nil || connack.Properties.SubIDAvailable
+	c.mutex.Unlock()
+
+	if !c.subIDs && !Quiet {
+		log.Info("MQTT broker does not support subscription identifiers, messages are routed by topic")
+	}
+	if c.options.OnConnect != nil {
+		go c.options.OnConnect(c)
+	}
+}
+
+func (c *mqtt5Client) connectError(err error) {
+	c.mutex.Lock()
+	c.connectErr = err
+	c.mutex.Unlock()
+
+	if Verbose {
+		log.Debugf("MQTT connection attempt failed: %v", err)
+	}
+}
+
+func (c *mqtt5Client) connectionLost(err error) {
+	c.mutex.Lock()
+	c.connected = false
+	c.mutex.Unlock()
+
+	if c.options.OnConnectionLost != nil {
+		c.options.OnConnectionLost(c, err)
+	}
+}
+
+// received calls the handler of the subscription, for which the
+// message was sent.
+func (c *mqtt5Client) received(pr paho.PublishReceived) (bool, error) {
+	p := pr.Packet
+	msg := &message{
+		topic:      p.Topic,
+		payload:    p.Payload,
+		qos:        p.QoS,
+		retained:   p.Retain,
+		properties: newMessageProperties(p.Properties),
+	}
+	for _, sub := range c.route(p) {
+		sub.handler(c, msg)
+	}
+	return true, nil
+}
+
+// route returns the subscriptions of a message. The client library
+// keeps only one subscription identifier per message, so if the
+// topic filters overlap, the subscriptions are looked up by topic
+// like for MQTT 3.1.1.
+func (c *mqtt5Client) route(p *paho.Publish) []*mqtt5Subscription {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if p.Properties != nil && p.Properties.SubscriptionIdentifier != nil && !c.overlapping {
+		if sub, ok := c.byID[*p.Properties.SubscriptionIdentifier]; ok {
+			return []*mqtt5Subscription{sub}
+		}
+	}
+
+	var result []*mqtt5Subscription
+	for _, sub := range c.subscriptions {
+		if topicMatches(sub.topic, p.Topic) {
+			result = append(result, sub)
+		}
+	}
+	return result
+}
+
+// filtersOverlap reports whether a topic exists, which matches both
+// topic filters.
+func filtersOverlap(a string, b string) bool {
+	_, a = splitSharedSubscription(a)
+	_, b = splitSharedSubscription(b)
+	fa := strings.Split(a, "/")
+	fb := strings.Split(b, "/")
+
+	for i := range fa {
+		if i >= len(fb) {
+			return fa[i] == "#"
+		}
+		if fa[i] == "#" || fb[i] == "#" {
+			return true
+		}
+		if fa[i] != "+" && fb[i] != "+" && fa[i] != fb[i] {
+			return false
+		}
+	}
+	return len(fa) == len(fb) || fb[len(fa)] == "#"
+}
+
+// register stores the handler for topic and returns the subscription.
+// c.mutex must be held.
+func (c *mqtt5Client) register(topic string, handler mqtt.MessageHandler) *mqtt5Subscription {
+	sub := c.subscriptions[topic]
+	if sub == nil {
+		c.nextID++
+		sub = &mqtt5Subscription{id: c.nextID, topic: topic}
+		for other := range c.subscriptions {
+			if filtersOverlap(other, topic) {
+				c.overlapping = true
+			}
+		}
+		c.subscriptions[topic] = sub
+		c.byID[sub.id] = sub
+	}
+	sub.handler = handler
+	return sub
+}
+
+// unregister removes the handler for topic. c.mutex must be held.
+func (c *mqtt5Client) unregister(topic string) {
+	sub := c.subscriptions[topic]
+	if sub == nil {
+		return
+	}
+	delete(c.subscriptions, topic)
+	delete(c.byID, sub.id)
+
+	c.overlapping = false
+	for a := range c.subscriptions {
+		for b := range c.subscriptions {
+			if a < b && filtersOverlap(a, b) {
+				c.overlapping = true
+			}
+		}
+	}
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+func (c *mqtt5Client) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+// Connect starts the connection manager, which reconnects on its own.
+// The token fails, if the first connection is not established within
+// the connect timeout. Calling Connect again waits for the connection
+// again.
+func (c *mqtt5Client) Connect() mqtt.Token {
+	c.mutex.Lock()
+	if c.manager == nil {
+		manager, err := autopaho.NewConnection(context.Background(), c.clientConfig())
+		if err != nil {
+			c.mutex.Unlock()
+			return runToken(func() error { return err })
+		}
+		c.manager = manager
+	}
+	manager := c.manager
+	c.mutex.Unlock()
+
+	return runToken(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), c.options.ConnectTimeout)
+		defer cancel()
+
+		if err := manager.AwaitConnection(ctx); err != nil {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			if c.connectErr != nil {
+				return c.connectErr
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// Disconnect closes the connection, quiesce is the time in
+// milliseconds to wait for the shutdown.
+func (c *mqtt5Client) Disconnect(quiesce uint) {
+	c.mutex.Lock()
+	manager := c.manager
+	c.connected = false
+	c.mutex.Unlock()
+
+	if manager == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	manager.Disconnect(ctx)
+}
+
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p := &paho.Publish{
+		Topic:  topic,
+		QoS:    qos,
+		Retain: retained,
+	}
+	switch v := payload.(type) {
+	case []byte:
+		p.Payload = v
+	case string:
+		p.Payload = []byte(v)
+	default:
+		return runToken(func() error { return fmt.Errorf("unsupported payload type %T", payload) })
+	}
+
+	c.mutex.Lock()
+	manager := c.manager
+	c.mutex.Unlock()
+
+	return runToken(func() error {
+		if manager == nil {
+			return mqtt.ErrNotConnected
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+		defer cancel()
+		_, err := manager.Publish(ctx, p)
+		return err
+	})
+}
+
+// Subscribe subscribes to topic, the handler is registered before
+// the subscription is made, so that no retained message is lost.
+func (c *mqtt5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mutex.Lock()
+	sub := c.register(topic, callback)
+	manager := c.manager
+	s := &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	}
+	if c.subIDs {
+		id := sub.id
+		s.Properties = &paho.SubscribeProperties{SubscriptionIdentifier: &id}
+	}
+	c.mutex.Unlock()
+
+	return runToken(func() error {
+		if manager == nil {
+			return mqtt.ErrNotConnected
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+		defer cancel()
+		_, err := manager.Subscribe(ctx, s)
+		return err
+	})
+}
+
+func (c *mqtt5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	var tokens []mqtt.Token
+	for topic, qos := range filters {
+		tokens = append(tokens, c.Subscribe(topic, qos, callback))
+	}
+	return runToken(func() error {
+		var err error
+		for _, t := range tokens {
+			t.Wait()
+			if t.Error() != nil && err == nil {
+				err = t.Error()
+			}
+		}
+		return err
+	})
+}
+
+func (c *mqtt5Client) Unsubscribe(topics ...string) mqtt.Token {
+	c.mutex.Lock()
+	for _, topic := range topics {
+		c.unregister(topic)
+	}
+	manager := c.manager
+	c.mutex.Unlock()
+
+	return runToken(func() error {
+		if manager == nil {
+			return mqtt.ErrNotConnected
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+		defer cancel()
+		_, err := manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+// AddRoute registers a handler for topic without subscribing.
+func (c *mqtt5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mutex.Lock()
+	c.register(topic, callback)
+	c.mutex.Unlock()
+}
+
+func (c *mqtt5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewClient(c.options).OptionsReader()
+}
@@ -0,0 +1,316 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	defDeviceIDRegex = "(.*/)?(?P<deviceid>.*)"
+)
+
+// ProfileType describes one subscription profile: the topics to
+// subscribe to, how device ID and metric name are extracted from
+// the topic and which metrics are looked for in the messages.
+type ProfileType struct {
+	Name                  string        `yaml:"name,omitempty"`
+	TopicPaths            []string      `yaml:"topic_paths"`
+	DeviceIDPattern       string        `yaml:"device_id_regex"`
+	MetricPerTopicPattern string        `yaml:"metric_per_topic_regex"`
+	QoS                   byte          `yaml:"qos"`
+	Retained              string        `yaml:"retained,omitempty"`
+	Measurement           string        `yaml:"measurement,omitempty"`
+	JsonPayload           bool          `yaml:"json_payload,omitempty"`
+	Metrics               []MetricsType `yaml:"metrics"`
+	// UserPropertyTags maps MQTT v5 user properties to tags
+	UserPropertyTags map[string]string `yaml:"user_property_tags,omitempty"`
+	// ContentTypeTag is the tag the MQTT v5 content type is stored in
+	ContentTypeTag string `yaml:"content_type_tag,omitempty"`
+	// SplitUnits stores values with different units as own points
+	SplitUnits bool `yaml:"split_units,omitempty"`
+
+	deviceIDRegex       *regexp.Regexp
+	metricPerTopicRegex *regexp.Regexp
+	measurementTmpl     *template.Template
+}
+
+var (
+	profiles []*ProfileType
+	// topicSubscribers maps every topic path to the profiles using
+	// it, it is created again whenever the profiles are replaced
+	topicSubscribers map[string][]*ProfileType
+)
+
+// setProfiles replaces the profiles. While messages are processed,
+// stateMutex must be held.
+func setProfiles(newProfiles []*ProfileType) {
+	subscribers := make(map[string][]*ProfileType)
+	for _, p := range newProfiles {
+		for _, topic := range p.TopicPaths {
+			subscribers[topic] = append(subscribers[topic], p)
+		}
+	}
+	profiles = newProfiles
+	topicSubscribers = subscribers
+}
+
+// firstTopicPath returns the first topic path of the profile matching
+// topic or "" if there is none.
+func (p *ProfileType) firstTopicPath(topic string) string {
+	for _, path := range p.TopicPaths {
+		if topicMatches(path, topic) {
+			return path
+		}
+	}
+	return ""
+}
+
+// compileRegex compiles pattern and verifies, that it contains the
+// named capture group.
+func compileRegex(option string, pattern string, group string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling %s: %v", option, err)
+	}
+	for _, name := range re.SubexpNames() {
+		if name == group {
+			return re, nil
+		}
+	}
+	return nil, fmt.Errorf("%s %q does not contain required regex group %q",
+		option, pattern, group)
+}
+
+// compile compiles the regular expressions and metrics of the
+// profile. All problems found are returned.
+func (p *ProfileType) compile() []error {
+	var errs []error
+	var err error
+
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("profile %q: "+format,
+			append([]interface{}{p.Name}, args...)...))
+	}
+
+	if len(p.TopicPaths) == 0 {
+		fail("no topic_paths specified")
+	}
+	for _, path := range p.TopicPaths {
+		if !strings.HasPrefix(path, sharePrefix) {
+			continue
+		}
+		group, filter := splitSharedSubscription(path)
+		if len(group) == 0 || strings.ContainsAny(group, "+#") || len(filter) == 0 {
+			fail("invalid shared subscription %q, expected $share/<group>/<topic filter>", path)
+		}
+	}
+	if p.QoS > 2 {
+		fail("invalid qos %d", p.QoS)
+	}
+	if len(p.DeviceIDPattern) == 0 {
+		p.DeviceIDPattern = defDeviceIDRegex
+	}
+	p.deviceIDRegex, err = compileRegex("device_id_regex",
+		p.DeviceIDPattern, deviceIDRegexGroup)
+	if err != nil {
+		fail("%v", err)
+	}
+	if len(p.MetricPerTopicPattern) > 0 {
+		p.metricPerTopicRegex, err = compileRegex("metric_per_topic_regex",
+			p.MetricPerTopicPattern, metricPerTopicRegexGroup)
+		if err != nil {
+			fail("%v", err)
+		}
+	} else if !p.JsonPayload {
+		// without metric name no message would match
+		fail("neither metric_per_topic_regex nor json_payload specified")
+	}
+	if len(p.Measurement) > 0 {
+		p.measurementTmpl, err = template.New(p.Name).Option("missingkey=zero").Parse(p.Measurement)
+		if err != nil {
+			fail("invalid measurement: %v", err)
+		}
+	}
+	switch p.Retained {
+	case "":
+		p.Retained = retainedProcess
+	case retainedProcess, retainedSkip, retainedFlag:
+	default:
+		fail("invalid value %q for retained", p.Retained)
+	}
+	for property, tag := range p.UserPropertyTags {
+		if len(tag) == 0 {
+			fail("user_property_tags: no tag name for user property %q", property)
+		}
+	}
+
+	names := make(map[string]string)
+	for i := range p.Metrics {
+		m := &p.Metrics[i]
+		if err := m.compile(p.JsonPayload); err != nil {
+			fail("%v", err)
+			continue
+		}
+		// the same name for the same topic would overwrite
+		// the value of the other metric
+		key := m.topicName + "\xff" + m.Name + "\xff" + m.KeyTag
+		if other, ok := names[key]; ok {
+			fail("metric %q: name already used for %q", m.Name, other)
+		} else {
+			names[key] = m.MqttName
+		}
+	}
+	return errs
+}
+
+// regexGroups returns all named groups of re matching topic.
+func regexGroups(re *regexp.Regexp, topic string) map[string]string {
+	values := make(map[string]string)
+	if re == nil {
+		return values
+	}
+	match := re.FindStringSubmatch(topic)
+	for i, name := range re.SubexpNames() {
+		if len(match) > i && name != "" {
+			values[name] = match[i]
+		}
+	}
+	return values
+}
+
+// topicGroups returns the named groups of device_id_regex and
+// metric_per_topic_regex, including the device ID and metric name.
+func (p *ProfileType) topicGroups(topic string) map[string]string {
+	values := regexGroups(p.deviceIDRegex, topic)
+	for k, v := range regexGroups(p.metricPerTopicRegex, topic) {
+		values[k] = v
+	}
+	return values
+}
+
+// measurementName returns the measurement name for the metric. Without
+// measurement template this is the device ID.
+func (p *ProfileType) measurementName(groups map[string]string, metric string) (string, error) {
+	if p.measurementTmpl == nil {
+		return groups[deviceIDRegexGroup], nil
+	}
+
+	data := make(map[string]string)
+	for k, v := range groups {
+		data[k] = v
+	}
+	data[metricTemplateKey] = metric
+
+	var b strings.Builder
+	if err := p.measurementTmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("cannot create measurement name: %v", err)
+	}
+	return b.String(), nil
+}
+
+// setupProfiles creates the list of profiles from the configuration.
+// The legacy topic_paths, device_id_regex and metric_per_topic_regex
+// entries of the mqtt section together with the global metrics
+// are converted to an additional profile. All problems found are
+// returned.
+func setupProfiles(config *ConfigType) ([]*ProfileType, []error) {
+	var result []*ProfileType
+
+	for i := range config.Profiles {
+		p := config.Profiles[i]
+		if len(p.Name) == 0 {
+			p.Name = fmt.Sprintf("profile-%d", i)
+		}
+		result = append(result, &p)
+	}
+
+	var errs []error
+	if config.MQTT != nil && len(config.MQTT.TopicPaths) > 0 {
+		result = append(result, &ProfileType{
+			Name:                  "default",
+			TopicPaths:            config.MQTT.TopicPaths,
+			DeviceIDPattern:       config.MQTT.DeviceIDPattern,
+			MetricPerTopicPattern: config.MQTT.MetricPerTopicPattern,
+			QoS:                   config.MQTT.QoS,
+			Retained:              config.MQTT.Retained,
+			Measurement:           config.MQTT.Measurement,
+			JsonPayload:           config.MQTT.JsonPayload,
+			UserPropertyTags:      config.MQTT.UserPropertyTags,
+			ContentTypeTag:        config.MQTT.ContentTypeTag,
+			SplitUnits:            config.MQTT.SplitUnits,
+			Metrics:               config.Metrics,
+		})
+	} else {
+		errs = append(errs, checkUnusedGlobals(config)...)
+	}
+
+	if len(result) == 0 {
+		return nil, append(errs, fmt.Errorf("No topic_paths or profiles specified"))
+	}
+
+	for _, p := range result {
+		errs = append(errs, p.compile()...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return result, nil
+}
+
+// checkUnusedGlobals compiles the global metrics and the regexes of the
+// mqtt section, which are only used together with mqtt.topic_paths, so
+// that errors in them are reported even if they are not used. Such
+// leftovers are an error, since they would be silently ignored.
+func checkUnusedGlobals(config *ConfigType) []error {
+	var errs []error
+	var unused []string
+
+	jsonPayload := false
+	if config.MQTT != nil {
+		jsonPayload = config.MQTT.JsonPayload
+		if len(config.MQTT.DeviceIDPattern) > 0 {
+			unused = append(unused, "mqtt.device_id_regex")
+			if _, err := compileRegex("device_id_regex",
+				config.MQTT.DeviceIDPattern, deviceIDRegexGroup); err != nil {
+				errs = append(errs, fmt.Errorf("mqtt: %v", err))
+			}
+		}
+		if len(config.MQTT.MetricPerTopicPattern) > 0 {
+			unused = append(unused, "mqtt.metric_per_topic_regex")
+			if _, err := compileRegex("metric_per_topic_regex",
+				config.MQTT.MetricPerTopicPattern, metricPerTopicRegexGroup); err != nil {
+				errs = append(errs, fmt.Errorf("mqtt: %v", err))
+			}
+		}
+	}
+	if len(config.Metrics) > 0 {
+		unused = append(unused, "metrics")
+		for i := range config.Metrics {
+			if err := config.Metrics[i].compile(jsonPayload); err != nil {
+				errs = append(errs, fmt.Errorf("metrics: %v", err))
+			}
+		}
+	}
+
+	if len(unused) > 0 {
+		errs = append(errs, fmt.Errorf("%s specified, but unused without mqtt.topic_paths",
+			strings.Join(unused, ", ")))
+	}
+	return errs
+}
@@ -0,0 +1,286 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+const (
+	defPrometheusPath      = "/metrics"
+	defPrometheusNamespace = "mqtt"
+	defPrometheusExpiry    = 5 * time.Minute
+	prometheusDeviceLabel  = "device"
+)
+
+type PrometheusConfig struct {
+	// Listener is the address of the HTTP server, if empty the
+	// health_check listener is used.
+	Listener  string `yaml:"listener,omitempty"`
+	Path      string `yaml:"path,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+	// Expiry is the time after which a series, which got no new
+	// value, is no longer exported. 0 uses the default, a negative
+	// value disables the expiry.
+	Expiry time.Duration `yaml:"expiry,omitempty"`
+}
+
+type promSeries struct {
+	name    string
+	labels  map[string]string
+	value   float64
+	updated time.Time
+}
+
+// promCollector keeps the last value of every metric per device
+// and exports them as gauges.
+type promCollector struct {
+	name      string
+	mutex     sync.Mutex
+	namespace string
+	expiry    time.Duration
+	series    map[string]*promSeries
+}
+
+var (
+	promRegistry = prometheus.NewRegistry()
+	promMetrics  *promCollector
+	// promHealthPath is the path of the prometheus sink on the
+	// health_check listener, if it uses it
+	promHealthPath string
+)
+
+// promName converts name into a valid prometheus metric or label name.
+func promName(name string) string {
+	var b strings.Builder
+
+	for i, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' ||
+			(c >= '0' && c <= '9' && i > 0) {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// promValue converts a field value into a gauge value. Strings
+// cannot be stored as gauge.
+func promValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func newPromCollector(name string, config *PrometheusConfig) *promCollector {
+	c := &promCollector{
+		name:      name,
+		namespace: config.Namespace,
+		expiry:    config.Expiry,
+		series:    make(map[string]*promSeries),
+	}
+	if len(c.namespace) == 0 {
+		c.namespace = defPrometheusNamespace
+	}
+	if c.expiry == 0 {
+		c.expiry = defPrometheusExpiry
+	}
+	return c
+}
+
+// Update stores the fields of a device as gauges.
+func (c *promCollector) Update(device string, tags map[string]string, fields map[string]interface{}) {
+	labels := make(map[string]string)
+	for k, v := range tags {
+		labels[promName(k)] = v
+	}
+	labels[prometheusDeviceLabel] = device
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for field, value := range fields {
+		f, ok := promValue(value)
+		if !ok {
+			if Verbose {
+				log.Debugf("%s: cannot export %s=%v as gauge", device, field, value)
+			}
+			continue
+		}
+
+		name := promName(c.namespace + "_" + field)
+		var key strings.Builder
+		key.WriteString(name)
+		for _, k := range keys {
+			fmt.Fprintf(&key, "\xff%s=%s", k, labels[k])
+		}
+
+		c.series[key.String()] = &promSeries{
+			name:    name,
+			labels:  labels,
+			value:   f,
+			updated: now,
+		}
+	}
+}
+
+// Write implements Sink
+func (c *promCollector) Write(p *Point) error {
+	device, ok := p.Tags[deviceTag]
+	if !ok {
+		device = p.Measurement
+	}
+	c.Update(device, p.Tags, p.Fields)
+	pointsWritten.WithLabelValues(c.name).Inc()
+	return nil
+}
+
+// Flush implements Sink, the values are kept in memory
+func (c *promCollector) Flush() error {
+	return nil
+}
+
+// Close implements Sink
+func (c *promCollector) Close() error {
+	return nil
+}
+
+// Describe implements prometheus.Collector. The metrics are not
+// known in advance, so this is an unchecked collector.
+func (c *promCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect implements prometheus.Collector
+func (c *promCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// All series of a metric need the same label names,
+	// so collect them first.
+	families := make(map[string]map[string]bool)
+	for key, s := range c.series {
+		if c.expiry > 0 && time.Since(s.updated) > c.expiry {
+			delete(c.series, key)
+			continue
+		}
+		if families[s.name] == nil {
+			families[s.name] = make(map[string]bool)
+		}
+		for l := range s.labels {
+			families[s.name][l] = true
+		}
+	}
+
+	descs := make(map[string]*prometheus.Desc)
+	labelNames := make(map[string][]string)
+	for name, labels := range families {
+		for l := range labels {
+			labelNames[name] = append(labelNames[name], l)
+		}
+		sort.Strings(labelNames[name])
+		descs[name] = prometheus.NewDesc(name,
+			"Last value received via MQTT", labelNames[name], nil)
+	}
+
+	for _, s := range c.series {
+		values := make([]string, len(labelNames[s.name]))
+		for i, l := range labelNames[s.name] {
+			values[i] = s.labels[l]
+		}
+		m, err := prometheus.NewConstMetric(descs[s.name],
+			prometheus.GaugeValue, s.value, values...)
+		if err != nil {
+			log.Errorf("Cannot export %s: %v", s.name, err)
+			continue
+		}
+		ch <- m
+	}
+}
+
+// setupPrometheus creates the collector and registers the HTTP
+// handler. If the prometheus listener is the same as the health
+// check listener, the handler is added to mux.
+func setupPrometheus(name string, config *PrometheusConfig, mux *http.ServeMux) error {
+	promMetrics = newPromCollector(name, config)
+	if err := promRegistry.Register(promMetrics); err != nil {
+		return err
+	}
+
+	if len(config.Path) == 0 {
+		config.Path = defPrometheusPath
+	}
+	handler := promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{})
+
+	addr := config.Listener
+	if len(addr) == 0 ||
+		(Config.HealthCheckListener != nil && addr == *Config.HealthCheckListener) {
+		if Config.HealthCheckListener == nil || len(*Config.HealthCheckListener) == 0 {
+			return fmt.Errorf("Neither prometheus listener nor health_check specified")
+		}
+		addr = *Config.HealthCheckListener
+		mux.Handle(config.Path, handler)
+		promHealthPath = config.Path
+	} else {
+		promMux := http.NewServeMux()
+		promMux.Handle(config.Path, handler)
+		promServer := &http.Server{
+			Addr:    config.Listener,
+			Handler: promMux,
+		}
+		go func() {
+			if err := promServer.ListenAndServe(); err != nil {
+				log.Errorf("Prometheus listener: %v", err)
+			}
+		}()
+	}
+
+	if !Quiet {
+		log.Infof("Prometheus metrics provided at %s%s", addr, config.Path)
+	}
+	return nil
+}
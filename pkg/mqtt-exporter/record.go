@@ -0,0 +1,348 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+const (
+	encodingBase64 = "base64"
+)
+
+// capturedMessage is one line of a capture file. Payloads, which
+// are no valid UTF-8, are stored base64 encoded.
+type capturedMessage struct {
+	Time     time.Time `json:"time"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"`
+	Encoding string    `json:"encoding,omitempty"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	// Properties are the MQTT v5 properties of the message
+	Properties *messageProperties `json:"properties,omitempty"`
+}
+
+func newCapturedMessage(msg mqtt.Message, received time.Time) *capturedMessage {
+	c := &capturedMessage{
+		Time:       received,
+		Topic:      msg.Topic(),
+		QoS:        msg.Qos(),
+		Retained:   msg.Retained(),
+		Properties: messagePropertiesOf(msg),
+	}
+	if utf8.Valid(msg.Payload()) {
+		c.Payload = string(msg.Payload())
+	} else {
+		c.Payload = base64.StdEncoding.EncodeToString(msg.Payload())
+		c.Encoding = encodingBase64
+	}
+	return c
+}
+
+func (c *capturedMessage) message() (*message, error) {
+	m := &message{
+		topic:      c.Topic,
+		qos:        c.QoS,
+		retained:   c.Retained,
+		properties: c.Properties,
+	}
+	switch c.Encoding {
+	case "":
+		m.payload = []byte(c.Payload)
+	case encodingBase64:
+		var err error
+
+		m.payload, err = base64.StdEncoding.DecodeString(c.Payload)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", c.Encoding)
+	}
+	return m, nil
+}
+
+// Record subscribes to the topic paths of all profiles and writes
+// every message received to the capture file.
+func Record(file string) {
+	if !Quiet {
+		log.Infof("MQTT Exporter (mqtt-exporter) %s is recording to %q...\n", Version, file)
+	}
+
+	newProfiles, errs := validateMQTT(&Config)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		log.Fatal("Invalid configuration!")
+	}
+	setProfiles(newProfiles)
+	// as member of the shared group, the messages would be
+	// taken away from the running exporters
+	Config.MQTT.SharedGroup = ""
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Cannot open %q: %v", file, err)
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	var mutex sync.Mutex
+	count := 0
+
+	record := func(msg mqtt.Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err := encoder.Encode(newCapturedMessage(msg, time.Now())); err != nil {
+			log.Errorf("Cannot write to %q: %v", file, err)
+			return
+		}
+		// write complete lines, so that nothing gets lost if
+		// the program gets killed
+		if err := w.Flush(); err != nil {
+			log.Errorf("Cannot write to %q: %v", file, err)
+		}
+		count++
+		if Verbose {
+			log.Debugf("Recorded message: topic: %s - %s", msg.Topic(), msg.Payload())
+		}
+	}
+
+	paths, qos := recordSubscriptions()
+	recordHandler := func(path string) mqtt.MessageHandler {
+		return func(client mqtt.Client, msg mqtt.Message) {
+			// the client passes a message to the handlers of all
+			// matching topic paths, only the first one records it
+			if firstMatch(paths, msg.Topic()) != path {
+				return
+			}
+			record(msg)
+		}
+	}
+
+	opts := mqttClientOptions(func(client mqtt.Client) {
+		log.Info("Connection to MQTT Broker established")
+		// Topic paths covered by another one are not subscribed,
+		// else the broker could send such messages once per
+		// subscription. Paths, which only partly overlap (like
+		// "a/+/c" and "a/b/+"), can still cause several copies,
+		// which cannot be told apart from repeated messages.
+		for _, path := range paths {
+			subscribeTopic(client, path, qos[path], recordHandler(path))
+		}
+	})
+	client := connectMQTT(opts)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, syscall.SIGTERM)
+	<-quit
+
+	client.Disconnect(250)
+	mutex.Lock()
+	w.Flush()
+	f.Close()
+	if !Quiet {
+		log.Infof("Recorded %d messages", count)
+	}
+	mutex.Unlock()
+}
+
+// Replay feeds the messages of a capture file into the configured
+// sinks. With realtime the messages are replayed at the original
+// speed, else as fast as possible.
+func Replay(file string, realtime bool) {
+	if !Quiet {
+		log.Infof("MQTT Exporter (mqtt-exporter) %s is replaying %q...\n", Version, file)
+	}
+
+	newProfiles, errs := setupProfiles(&Config)
+	setProfiles(newProfiles)
+	errs = append(errs, validateSinks(&Config)...)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		log.Fatal("Invalid configuration!")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("Cannot open %q: %v", file, err)
+	}
+	defer f.Close()
+
+	// The prometheus sink could use the health check listener,
+	// which is not started for a replay.
+	sinks, err = setupSinks(&Config, http.NewServeMux())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeSinks()
+
+	subscribers := subscriptions()
+	var last time.Time
+	count := 0
+
+	scanner := bufio.NewScanner(f)
+	// payloads can be larger than the default 64k
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var c capturedMessage
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			log.Errorf("%s:%d: %v", file, line, err)
+			continue
+		}
+		msg, err := c.message()
+		if err != nil {
+			log.Errorf("%s:%d: %v", file, line, err)
+			continue
+		}
+
+		if realtime && !last.IsZero() && c.Time.After(last) {
+			time.Sleep(c.Time.Sub(last))
+		}
+		last = c.Time
+
+		// with overlapping topic paths (like "a/#" and "a/+/b")
+		// several paths match, but every profile gets the
+		// message only once
+		for _, p := range matchingProfiles(subscribers, msg.Topic()) {
+			msgHandler(p, msg, c.Time)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Cannot read %q: %v", file, err)
+	}
+	if !Quiet {
+		log.Infof("Replayed %d messages", count)
+	}
+}
+
+// filterCovers reports whether every topic matching other matches
+// filter, too. Shared subscriptions are delivered differently and
+// never cover or are covered.
+func filterCovers(filter string, other string) bool {
+	if strings.HasPrefix(filter, sharePrefix) || strings.HasPrefix(other, sharePrefix) {
+		return false
+	}
+	f := strings.Split(filter, "/")
+	o := strings.Split(other, "/")
+
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(o) || o[i] == "#" {
+			return false
+		}
+		if f[i] != "+" && f[i] != o[i] {
+			return false
+		}
+	}
+	return len(f) == len(o)
+}
+
+// recordSubscriptions returns the sorted topic paths to record and
+// their QoS. Topic paths covered by another one are left out, the
+// covering one gets the highest QoS of both.
+func recordSubscriptions() ([]string, map[string]byte) {
+	subs := subscriptions()
+	var paths []string
+	qos := make(map[string]byte)
+
+	for path := range subs {
+		covered := false
+		for other := range subs {
+			if other != path && filterCovers(other, path) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		for other, subscribers := range subs {
+			if other == path || filterCovers(path, other) {
+				if q := subscriptionQoS(subscribers); q > qos[path] {
+					qos[path] = q
+				}
+			}
+		}
+	}
+	return paths, qos
+}
+
+// firstMatch returns the first of the sorted topic paths matching
+// topic or "" if there is none.
+func firstMatch(paths []string, topic string) string {
+	for _, path := range paths {
+		if topicMatches(path, topic) {
+			return path
+		}
+	}
+	return ""
+}
+
+// matchingProfiles returns the profiles subscribed to topic, every
+// profile only once, even if several of its topic paths match.
+func matchingProfiles(subscribers map[string][]*ProfileType, topic string) []*ProfileType {
+	var paths []string
+	for path := range subscribers {
+		if topicMatches(path, topic) {
+			paths = append(paths, path)
+		}
+	}
+	// the order of the profiles should not depend on the map
+	sort.Strings(paths)
+
+	var result []*ProfileType
+	seen := make(map[*ProfileType]bool)
+	for _, path := range paths {
+		for _, p := range subscribers[path] {
+			if !seen[p] {
+				seen[p] = true
+				result = append(result, p)
+			}
+		}
+	}
+	return result
+}
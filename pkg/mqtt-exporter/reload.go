@@ -0,0 +1,269 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+const (
+	watchInterval = 5 * time.Second
+)
+
+var (
+	// ReloadConfig reads the configuration again, it is called
+	// on SIGHUP and if WatchConfigFile changed.
+	ReloadConfig func() (ConfigType, error)
+	// WatchConfigFile is checked for changes every watchInterval,
+	// if not empty.
+	WatchConfigFile string
+
+	// stateMutex protects Config, profiles and sinks, which are
+	// replaced by a reload while messages are processed.
+	stateMutex sync.RWMutex
+)
+
+// triggerReload requests a reload, if there is already one pending,
+// nothing happens.
+func triggerReload(trigger chan<- struct{}) {
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+// watchConfig checks the modification time and size of file and
+// triggers a reload if they change. Since stat follows symlinks,
+// this works for Kubernetes ConfigMaps, too.
+func watchConfig(file string, trigger chan<- struct{}) {
+	var modTime time.Time
+	var size int64
+
+	if fi, err := os.Stat(file); err == nil {
+		modTime = fi.ModTime()
+		size = fi.Size()
+	}
+
+	for range time.Tick(watchInterval) {
+		fi, err := os.Stat(file)
+		if err != nil {
+			if Verbose {
+				log.Debugf("Cannot check %q: %v", file, err)
+			}
+			continue
+		}
+		if fi.ModTime().Equal(modTime) && fi.Size() == size {
+			continue
+		}
+		modTime = fi.ModTime()
+		size = fi.Size()
+		log.Infof("%q changed", file)
+		triggerReload(trigger)
+	}
+}
+
+// connectionChanged reports whether the connection to the MQTT
+// broker would be different with the new configuration.
+func connectionChanged(old *MQTTConfig, new *MQTTConfig) bool {
+	return old.Broker != new.Broker || old.Port != new.Port ||
+		old.Protocol != new.Protocol || old.User != new.User ||
+		old.Password != new.Password || old.ClientID != new.ClientID ||
+		old.ProtocolVersion != new.ProtocolVersion ||
+		old.SharedGroup != new.SharedGroup ||
+		!reflect.DeepEqual(old.TLS, new.TLS)
+}
+
+// reloadSinks creates the sinks for the new configuration. Sinks with
+// an unchanged configuration are kept. The prometheus sink cannot be
+// changed, since the HTTP handlers cannot be removed.
+func reloadSinks(config *ConfigType) ([]namedSink, error) {
+	var result []namedSink
+	var created []namedSink
+
+	fail := func(err error) ([]namedSink, error) {
+		for _, s := range created {
+			s.Close()
+		}
+		return nil, err
+	}
+
+	configs := sinkConfigs(config)
+	used := make(map[int]bool)
+
+	for _, sc := range configs {
+		found := false
+		for i, s := range sinks {
+			if !used[i] && s.name == sc.Name && reflect.DeepEqual(s.config, sc) {
+				result = append(result, s)
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		if sc.Prometheus != nil {
+			return fail(fmt.Errorf("sink %q: changing the prometheus sink requires a restart", sc.Name))
+		}
+		sink, err := newSink(sc, nil)
+		if err != nil {
+			return fail(err)
+		}
+		created = append(created, sink)
+		result = append(result, sink)
+	}
+
+	for i, s := range sinks {
+		if !used[i] && s.config.Prometheus != nil {
+			return fail(fmt.Errorf("sink %q: removing the prometheus sink requires a restart", s.name))
+		}
+	}
+	return result, nil
+}
+
+// containsSink reports whether sink is in list.
+func containsSink(list []namedSink, sink namedSink) bool {
+	for _, s := range list {
+		if s.Sink == sink.Sink {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads and validates the configuration and replaces profiles
+// and sinks. Subscriptions are only changed for modified topic paths.
+// If the new configuration is invalid, the old one is kept.
+func reload(client mqtt.Client) {
+	if !Quiet {
+		log.Info("Reloading configuration...")
+	}
+
+	if ReloadConfig == nil {
+		log.Error("Reload not supported")
+		return
+	}
+
+	config, err := ReloadConfig()
+	if err != nil {
+		log.Errorf("%v", err)
+		log.Error("Reload failed, keeping the old configuration")
+		return
+	}
+	if errs := ValidateConfig(&config); len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		log.Error("Reload failed, keeping the old configuration")
+		return
+	}
+	newProfiles, _ := setupProfiles(&config)
+
+	// The connection to the broker and the health check
+	// listener are only set up at start
+	mqttDefaults(config.MQTT)
+	if connectionChanged(Config.MQTT, config.MQTT) {
+		log.Warn("Changes of the MQTT broker connection require a restart, ignored")
+		config.MQTT.Broker = Config.MQTT.Broker
+		config.MQTT.Port = Config.MQTT.Port
+		config.MQTT.Protocol = Config.MQTT.Protocol
+		config.MQTT.User = Config.MQTT.User
+		config.MQTT.Password = Config.MQTT.Password
+		config.MQTT.ClientID = Config.MQTT.ClientID
+		config.MQTT.TLS = Config.MQTT.TLS
+		config.MQTT.ProtocolVersion = Config.MQTT.ProtocolVersion
+		config.MQTT.SharedGroup = Config.MQTT.SharedGroup
+	}
+	if !reflect.DeepEqual(Config.HealthCheckListener, config.HealthCheckListener) {
+		log.Warn("Changes of health_check require a restart, ignored")
+		config.HealthCheckListener = Config.HealthCheckListener
+	}
+
+	newSinks, err := reloadSinks(&config)
+	if err != nil {
+		log.Error(err)
+		log.Error("Reload failed, keeping the old configuration")
+		return
+	}
+	newDeadLetter, err := setupDeadLetter(config.DeadLetter, client)
+	if err != nil {
+		for _, s := range newSinks {
+			if !containsSink(sinks, s) {
+				s.Close()
+			}
+		}
+		log.Error(err)
+		log.Error("Reload failed, keeping the old configuration")
+		return
+	}
+
+	stateMutex.Lock()
+	oldSubscriptions := subscriptions()
+	oldSinks := sinks
+	oldDeadLetter := deadLetter
+	Config = config
+	if Config.Verbose != nil {
+		Verbose = *Config.Verbose
+	}
+	setProfiles(newProfiles)
+	sinks = newSinks
+	deadLetter = newDeadLetter
+	newSubscriptions := subscriptions()
+	stateMutex.Unlock()
+
+	// close the sinks, which are no longer used, all
+	// pending points get written
+	for _, old := range oldSinks {
+		if !containsSink(newSinks, old) {
+			if err := old.Close(); err != nil {
+				log.Errorf("Error closing %s: %v", old.name, err)
+			}
+		}
+	}
+
+	oldDeadLetter.close()
+
+	// without connection, the new profiles are subscribed
+	// by the connect handler
+	if client != nil && client.IsConnectionOpen() {
+		for topic := range oldSubscriptions {
+			if _, ok := newSubscriptions[topic]; !ok {
+				client.Unsubscribe(subscriptionTopic(topic))
+				if !Quiet {
+					log.Infof("Unsubscribed from topic: %s", subscriptionTopic(topic))
+				}
+			}
+		}
+		for topic, subscribers := range newSubscriptions {
+			qos := subscriptionQoS(subscribers)
+			if old, ok := oldSubscriptions[topic]; ok && subscriptionQoS(old) == qos {
+				continue
+			}
+			subscribeTopic(client, topic, qos, newMsgHandler(topic))
+		}
+	}
+
+	if !Quiet {
+		log.Info("Configuration reloaded")
+	}
+}
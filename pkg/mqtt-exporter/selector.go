@@ -0,0 +1,453 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+// A selector is a path into a JSON document. It is a superset of the
+// gojsonq "Find" syntax, which was used before:
+//
+//   a.b.c          keys separated by dots
+//   a.*.c          any key of an object or any element of an array
+//   a.switch:*.c   keys matching a glob pattern
+//   a[0] / a.[0]   element of an array, negative values count from
+//                  the end
+//   a[*]           all elements of an array
+//   a["b.c"]       keys containing dots or brackets
+//   a[?(@.id==0)]  elements, for which the expression is true. The
+//                  operators ==, !=, <, <=, > and >= are supported,
+//                  the value can be a number, a string, true, false
+//                  or null.
+//
+// A selector with wildcards or filters can match several values.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	segmentKey segmentKind = iota
+	segmentGlob
+	segmentIndex
+	segmentAll
+	segmentFilter
+)
+
+type segment struct {
+	kind   segmentKind
+	key    string
+	index  int
+	filter *filterExpr
+}
+
+type filterExpr struct {
+	path  *selector
+	op    string
+	value interface{}
+}
+
+type selector struct {
+	path     string
+	segments []segment
+}
+
+// selectorMatch is a value found by a selector. Key contains the keys
+// or indexes matched by wildcards or filters, joined by ".".
+type selectorMatch struct {
+	Value interface{}
+	Key   string
+}
+
+// parseJSON decodes a JSON document, numbers are kept as json.Number
+// so that no precision is lost.
+func parseJSON(payload []byte) (interface{}, error) {
+	var doc interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// findClosing returns the index of the "]" closing the "[" at
+// position start, brackets and parentheses inside of quotes are
+// ignored.
+func findClosing(path string, start int) int {
+	var quote byte
+	depth := 0
+
+	for i := start; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// unquote removes the quotes of a '...' or "..." string
+func unquote(s string) (string, bool) {
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return "", false
+	}
+	if s[0] == '\'' {
+		s = "\"" + strings.ReplaceAll(s[1:len(s)-1], "\"", "\\\"") + "\""
+	}
+	u, err := strconv.Unquote(s)
+	if err != nil {
+		return "", false
+	}
+	return u, true
+}
+
+// parseLiteral parses the right hand side of a filter expression
+func parseLiteral(s string) (interface{}, error) {
+	if u, ok := unquote(s); ok {
+		return u, nil
+	}
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", s)
+	}
+	return f, nil
+}
+
+func parseFilter(expr string) (*filterExpr, error) {
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		i := strings.Index(expr, op)
+		if i < 0 {
+			continue
+		}
+		lhs := strings.TrimSpace(expr[:i])
+		rhs := strings.TrimSpace(expr[i+len(op):])
+
+		if lhs != "@" && !strings.HasPrefix(lhs, "@.") && !strings.HasPrefix(lhs, "@[") {
+			return nil, fmt.Errorf("filter %q must start with @", expr)
+		}
+		path, err := parseSelector(strings.TrimPrefix(lhs[1:], "."))
+		if err != nil {
+			return nil, err
+		}
+		value, err := parseLiteral(rhs)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %v", expr, err)
+		}
+		return &filterExpr{path: path, op: op, value: value}, nil
+	}
+	return nil, fmt.Errorf("filter %q has no comparison operator", expr)
+}
+
+func parseBracket(content string) (segment, error) {
+	content = strings.TrimSpace(content)
+
+	if content == "*" {
+		return segment{kind: segmentAll}, nil
+	}
+	if key, ok := unquote(content); ok {
+		return segment{kind: segmentKey, key: key}, nil
+	}
+	if strings.HasPrefix(content, "?(") && strings.HasSuffix(content, ")") {
+		filter, err := parseFilter(content[2 : len(content)-1])
+		if err != nil {
+			return segment{}, err
+		}
+		return segment{kind: segmentFilter, filter: filter}, nil
+	}
+	index, err := strconv.Atoi(content)
+	if err != nil {
+		return segment{}, fmt.Errorf("invalid array index %q", content)
+	}
+	return segment{kind: segmentIndex, index: index}, nil
+}
+
+// parseSelector converts path into a selector.
+func parseSelector(path string) (*selector, error) {
+	s := &selector{path: path}
+
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+		case '[':
+			end := findClosing(path, i)
+			if end < 0 {
+				return nil, fmt.Errorf("%q: missing ']'", path)
+			}
+			seg, err := parseBracket(path[i+1 : end])
+			if err != nil {
+				return nil, fmt.Errorf("%q: %v", path, err)
+			}
+			s.segments = append(s.segments, seg)
+			i = end + 1
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path)
+			} else {
+				end += i
+			}
+			key := path[i:end]
+			if key == "*" {
+				s.segments = append(s.segments, segment{kind: segmentAll})
+			} else if strings.Contains(key, "*") {
+				s.segments = append(s.segments, segment{kind: segmentGlob, key: key})
+			} else {
+				s.segments = append(s.segments, segment{kind: segmentKey, key: key})
+			}
+			i = end
+		}
+	}
+	return s, nil
+}
+
+// globMatch reports whether s matches pattern, which can contain "*"
+// for any number of characters.
+func globMatch(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for i := 1; i < len(parts)-1; i++ {
+		j := strings.Index(s, parts[i])
+		if j < 0 {
+			return false
+		}
+		s = s[j+len(parts[i]):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// compareValues compares a JSON value with a filter literal
+func compareValues(a interface{}, op string, b interface{}) bool {
+	if n, ok := a.(json.Number); ok {
+		f, err := n.Float64()
+		if err != nil {
+			return false
+		}
+		a = f
+	}
+
+	switch bv := b.(type) {
+	case float64:
+		av, ok := a.(float64)
+		if !ok {
+			if s, isString := a.(string); isString {
+				var err error
+				if av, err = strconv.ParseFloat(s, 64); err != nil {
+					return op == "!="
+				}
+			} else {
+				return op == "!="
+			}
+		}
+		switch op {
+		case "==":
+			return av == bv
+		case "!=":
+			return av != bv
+		case "<":
+			return av < bv
+		case "<=":
+			return av <= bv
+		case ">":
+			return av > bv
+		case ">=":
+			return av >= bv
+		}
+	case string:
+		av, ok := a.(string)
+		if !ok {
+			return op == "!="
+		}
+		switch op {
+		case "==":
+			return av == bv
+		case "!=":
+			return av != bv
+		case "<":
+			return av < bv
+		case "<=":
+			return av <= bv
+		case ">":
+			return av > bv
+		case ">=":
+			return av >= bv
+		}
+	default:
+		// bool and null only support equality
+		switch op {
+		case "==":
+			return a == b
+		case "!=":
+			return a != b
+		}
+	}
+	return false
+}
+
+func (f *filterExpr) matches(value interface{}) bool {
+	found := f.path.find(value)
+	if len(found) == 0 {
+		return f.op == "!="
+	}
+	return compareValues(found[0].Value, f.op, f.value)
+}
+
+func joinKey(prefix string, key string) string {
+	if len(prefix) == 0 {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// children returns the elements of an object or array, for objects
+// sorted by key.
+func children(value interface{}) []selectorMatch {
+	var result []selectorMatch
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result = append(result, selectorMatch{Value: v[k], Key: k})
+		}
+	case []interface{}:
+		for i := range v {
+			result = append(result, selectorMatch{Value: v[i], Key: strconv.Itoa(i)})
+		}
+	}
+	return result
+}
+
+func (seg *segment) apply(m selectorMatch) []selectorMatch {
+	var result []selectorMatch
+
+	switch seg.kind {
+	case segmentKey:
+		if obj, ok := m.Value.(map[string]interface{}); ok {
+			if v, ok := obj[seg.key]; ok {
+				result = append(result, selectorMatch{Value: v, Key: m.Key})
+			}
+		}
+	case segmentIndex:
+		if arr, ok := m.Value.([]interface{}); ok {
+			i := seg.index
+			if i < 0 {
+				i = len(arr) + i
+			}
+			if i >= 0 && i < len(arr) {
+				result = append(result, selectorMatch{Value: arr[i], Key: m.Key})
+			}
+		}
+	case segmentAll, segmentGlob, segmentFilter:
+		for _, c := range children(m.Value) {
+			if seg.kind == segmentGlob && !globMatch(seg.key, c.Key) {
+				continue
+			}
+			if seg.kind == segmentFilter && !seg.filter.matches(c.Value) {
+				continue
+			}
+			result = append(result, selectorMatch{Value: c.Value, Key: joinKey(m.Key, c.Key)})
+		}
+	}
+	return result
+}
+
+// find returns all values of doc matching the selector.
+func (s *selector) find(doc interface{}) []selectorMatch {
+	matches := []selectorMatch{{Value: doc}}
+
+	for i := range s.segments {
+		var next []selectorMatch
+		for _, m := range matches {
+			next = append(next, s.segments[i].apply(m)...)
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		matches = next
+	}
+	return matches
+}
+
+// multiple reports whether the selector contains wildcards and can
+// match more than one value. Filters are expected to select a single
+// element and are not taken into account, if several elements match
+// a filter, only the first one is used.
+func (s *selector) multiple() bool {
+	for _, seg := range s.segments {
+		if seg.kind == segmentAll || seg.kind == segmentGlob {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonString converts a JSON value into the string representation
+// used for the type conversion.
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return "null"
+	case bool, float64:
+		return fmt.Sprintf("%v", v)
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(b)
+}
@@ -0,0 +1,190 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"strings"
+	"testing"
+)
+
+const selectorTestDoc = `{
+	"a": {"b": {"c": 1}},
+	"b.c": 2,
+	"x[0]": 3,
+	"arr": [10, 20, 30],
+	"switch:0": {"apower": 5},
+	"switch:1": {"apower": 6},
+	"input:0": {"apower": 7},
+	"sensors": [
+		{"id": 0, "name": "in", "v": 20.5, "ok": true},
+		{"id": 1, "name": "out", "v": -3, "ok": false},
+		{"id": 2, "name": "roof", "v": "7", "ok": null}
+	]
+}`
+
+func TestSelectorFind(t *testing.T) {
+	doc, err := parseJSON([]byte(selectorTestDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		values   []string
+		keys     []string
+		multiple bool
+	}{
+		// keys
+		{"a.b.c", []string{"1"}, []string{""}, false},
+		{"a.b", []string{`{"c":1}`}, []string{""}, false},
+		{"a.missing", nil, nil, false},
+		{`["b.c"]`, []string{"2"}, []string{""}, false},
+		{`['b.c']`, []string{"2"}, []string{""}, false},
+		{`["x[0]"]`, []string{"3"}, []string{""}, false},
+		// array indexes
+		{"arr[0]", []string{"10"}, []string{""}, false},
+		{"arr.[1]", []string{"20"}, []string{""}, false},
+		{"arr[-1]", []string{"30"}, []string{""}, false},
+		{"arr[3]", nil, nil, false},
+		{"arr[-4]", nil, nil, false},
+		{"a[0]", nil, nil, false},
+		// wildcards, objects are sorted by key
+		{"arr[*]", []string{"10", "20", "30"}, []string{"0", "1", "2"}, true},
+		{"arr.*", []string{"10", "20", "30"}, []string{"0", "1", "2"}, true},
+		{"a.*.c", []string{"1"}, []string{"b"}, true},
+		{"switch:*.apower", []string{"5", "6"}, []string{"switch:0", "switch:1"}, true},
+		{"*:0.apower", []string{"7", "5"}, []string{"input:0", "switch:0"}, true},
+		{"sensors[*].id", []string{"0", "1", "2"}, []string{"0", "1", "2"}, true},
+		// filters
+		{"sensors[?(@.id==1)].v", []string{"-3"}, []string{"1"}, false},
+		{"sensors[?(@.id!=1)].name", []string{"in", "roof"}, []string{"0", "2"}, false},
+		{"sensors[?(@.id>0)].name", []string{"out", "roof"}, []string{"1", "2"}, false},
+		{"sensors[?(@.id>=1)].name", []string{"out", "roof"}, []string{"1", "2"}, false},
+		{"sensors[?(@.id<1)].name", []string{"in"}, []string{"0"}, false},
+		{"sensors[?(@.id<=1)].name", []string{"in", "out"}, []string{"0", "1"}, false},
+		{`sensors[?(@.name=="out")].v`, []string{"-3"}, []string{"1"}, false},
+		{`sensors[?(@.name=='roof')].id`, []string{"2"}, []string{"2"}, false},
+		{`sensors[?(@.name>"out")].id`, []string{"2"}, []string{"2"}, false},
+		{"sensors[?(@.ok==true)].id", []string{"0"}, []string{"0"}, false},
+		{"sensors[?(@.ok==false)].id", []string{"1"}, []string{"1"}, false},
+		{"sensors[?(@.ok==null)].id", []string{"2"}, []string{"2"}, false},
+		{"sensors[?(@.ok!=null)].id", []string{"0", "1"}, []string{"0", "1"}, false},
+		// strings are compared as numbers with numeric literals
+		{"sensors[?(@.v>5)].id", []string{"0", "2"}, []string{"0", "2"}, false},
+		// a missing path only matches !=
+		{"sensors[?(@.missing==1)].id", nil, nil, false},
+		{"sensors[?(@.missing!=1)].id", []string{"0", "1", "2"}, []string{"0", "1", "2"}, false},
+		{"arr[?(@>15)]", []string{"20", "30"}, []string{"1", "2"}, false},
+		{"sensors[?(@.id==5)].v", nil, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			s, err := parseSelector(tt.path)
+			if err != nil {
+				t.Fatalf("parseSelector(%q): %v", tt.path, err)
+			}
+			if s.multiple() != tt.multiple {
+				t.Errorf("multiple() = %v, want %v", s.multiple(), tt.multiple)
+			}
+
+			var values, keys []string
+			for _, m := range s.find(doc) {
+				values = append(values, jsonString(m.Value))
+				keys = append(keys, m.Key)
+			}
+			if strings.Join(values, "|") != strings.Join(tt.values, "|") ||
+				len(values) != len(tt.values) {
+				t.Errorf("values = %q, want %q", values, tt.values)
+			}
+			if strings.Join(keys, "|") != strings.Join(tt.keys, "|") {
+				t.Errorf("keys = %q, want %q", keys, tt.keys)
+			}
+		})
+	}
+}
+
+func TestSelectorNestedKeys(t *testing.T) {
+	doc, err := parseJSON([]byte(`{"dev": [{"ch": {"a": 1, "b": 2}}, {"ch": {"a": 3}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := parseSelector("dev[*].ch.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, m := range s.find(doc) {
+		keys = append(keys, m.Key)
+	}
+	// the keys of all wildcards are joined by "."
+	if got, want := strings.Join(keys, " "), "0.a 0.b 1.a"; got != want {
+		t.Errorf("keys = %q, want %q", got, want)
+	}
+}
+
+func TestSelectorErrors(t *testing.T) {
+	tests := []struct {
+		path string
+		err  string
+	}{
+		{"a[0", "missing ']'"},
+		{"a[x]", "invalid array index"},
+		{"a[1.5]", "invalid array index"},
+		{`a["b]`, "missing ']'"},
+		{"a[?(@.id)]", "no comparison operator"},
+		{"a[?(id==1)]", "must start with @"},
+		{"a[?(@.id==abc)]", "invalid value"},
+		{"a[?(@.id==1]", "missing ']'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := parseSelector(tt.path)
+			if err == nil {
+				t.Fatalf("parseSelector(%q) succeeded, want error %q", tt.path, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"switch:*", "switch:0", true},
+		{"switch:*", "switch:", true},
+		{"switch:*", "input:0", false},
+		{"*:0", "switch:0", true},
+		{"*:0", "switch:1", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+		{"a*a", "a", false},
+		{"*", "", true},
+	}
+
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+// Point is the normalized form of a decoded message, which is
+// handed to the sinks.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// Sink is the interface every output backend has to implement.
+type Sink interface {
+	// Write queues the point for writing.
+	Write(p *Point) error
+	// Flush writes all queued points.
+	Flush() error
+	// Close flushes all queued points and releases the resources.
+	Close() error
+}
+
+// SinkConfig describes one output backend. Exactly one of the
+// backend specific entries must be set.
+type SinkConfig struct {
+	Name       string            `yaml:"name,omitempty"`
+	InfluxDB   *InfluxDBConfig   `yaml:"influxdb,omitempty"`
+	Prometheus *PrometheusConfig `yaml:"prometheus,omitempty"`
+}
+
+type namedSink struct {
+	name   string
+	config SinkConfig
+	Sink
+}
+
+var (
+	sinks []namedSink
+)
+
+// sinkConfigs returns the list of all configured sinks. The
+// influxdb and prometheus entries of the main section are
+// added in front of the list.
+func sinkConfigs(config *ConfigType) []SinkConfig {
+	var result []SinkConfig
+
+	if config.InfluxDB != nil {
+		result = append(result, SinkConfig{Name: "influxdb", InfluxDB: config.InfluxDB})
+	}
+	if config.Prometheus != nil {
+		result = append(result, SinkConfig{Name: "prometheus", Prometheus: config.Prometheus})
+	}
+	for i, sc := range config.Sinks {
+		if len(sc.Name) == 0 {
+			sc.Name = fmt.Sprintf("sink-%d", i)
+		}
+		result = append(result, sc)
+	}
+	return result
+}
+
+// setupSinks creates all configured sinks. HTTP handlers, which
+// should be served on the health_check listener, are added to mux.
+func setupSinks(config *ConfigType, mux *http.ServeMux) ([]namedSink, error) {
+	var result []namedSink
+
+	configs := sinkConfigs(config)
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("No sink specified")
+	}
+
+	for _, sc := range configs {
+		sink, err := newSink(sc, mux)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sink)
+	}
+	return result, nil
+}
+
+// newSink creates the sink described by sc. The configuration is
+// copied, so that sc can be compared with a new configuration on
+// reload.
+func newSink(sc SinkConfig, mux *http.ServeMux) (namedSink, error) {
+	var sink Sink
+	var err error
+
+	if sc.InfluxDB != nil && sc.Prometheus != nil {
+		return namedSink{}, fmt.Errorf("sink %q: only one of influxdb and prometheus allowed", sc.Name)
+	} else if sc.InfluxDB != nil {
+		if Verbose {
+			log.Debugf("Try to connect to InfluxDB (%s)...", sc.Name)
+		}
+		config := *sc.InfluxDB
+		sink, err = newInfluxDBSink(sc.Name, &config)
+	} else if sc.Prometheus != nil {
+		if promMetrics != nil {
+			return namedSink{}, fmt.Errorf("sink %q: only one prometheus sink allowed", sc.Name)
+		}
+		config := *sc.Prometheus
+		err = setupPrometheus(sc.Name, &config, mux)
+		sink = promMetrics
+	} else {
+		return namedSink{}, fmt.Errorf("sink %q: no backend specified", sc.Name)
+	}
+	if err != nil {
+		return namedSink{}, fmt.Errorf("sink %q: %v", sc.Name, err)
+	}
+	return namedSink{name: sc.Name, config: sc, Sink: sink}, nil
+}
+
+// writePoint hands the point over to all sinks.
+func writePoint(p *Point) {
+	for _, s := range sinks {
+		if err := s.Write(p); err != nil {
+			pointsFailed.WithLabelValues(s.name).Inc()
+			log.Errorf("Write error (%s, %s): %v", s.name, p.Measurement, err)
+		}
+	}
+}
+
+// flushSinks writes all queued points of all sinks.
+func flushSinks() {
+	for _, s := range sinks {
+		if err := s.Flush(); err != nil {
+			log.Errorf("Error flushing %s: %v", s.name, err)
+		}
+	}
+}
+
+// closeSinks flushes and closes all sinks.
+func closeSinks() {
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			log.Errorf("Error closing %s: %v", s.name, err)
+		}
+	}
+}
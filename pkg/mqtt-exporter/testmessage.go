@@ -0,0 +1,127 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// message is a MQTT message, which was not received from a broker,
+// e.g. to test the configuration.
+type message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+	// properties are the MQTT v5 properties or nil
+	properties *messageProperties
+}
+
+func (m *message) Duplicate() bool   { return false }
+func (m *message) Qos() byte         { return m.qos }
+func (m *message) Retained() bool    { return m.retained }
+func (m *message) Topic() string     { return m.topic }
+func (m *message) MessageID() uint16 { return 0 }
+func (m *message) Payload() []byte   { return m.payload }
+func (m *message) Ack()              {}
+
+// splitSharedSubscription splits a shared subscription
+// "$share/<group>/<filter>" into the group and the topic filter.
+// For other topic filters the group is empty.
+func splitSharedSubscription(filter string) (string, string) {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return "", filter
+	}
+	group, topicFilter, _ := strings.Cut(filter[len(sharePrefix):], "/")
+	return group, topicFilter
+}
+
+// topicMatches reports whether topic matches the subscription filter,
+// which can contain the wildcards "+" and "#" and can be a shared
+// subscription.
+func topicMatches(filter string, topic string) bool {
+	_, filter = splitSharedSubscription(filter)
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if f[i] != "+" && f[i] != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// TestMessage converts a message with every profile subscribed to the
+// topic and writes all decisions and the resulting points to out.
+// userProperties are the MQTT v5 user properties of the message.
+// No connection to the MQTT broker or the database is made.
+func TestMessage(config *ConfigType, topic string, payload []byte, retained bool, userProperties map[string]string, out io.Writer) error {
+	profiles, errs := setupProfiles(config)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	msg := &message{topic: topic, payload: payload, retained: retained,
+		properties: userPropertiesFromMap(userProperties)}
+	matched := false
+
+	for _, p := range profiles {
+		filter := ""
+		for _, f := range p.TopicPaths {
+			if topicMatches(f, topic) {
+				filter = f
+				break
+			}
+		}
+		if len(filter) == 0 {
+			fmt.Fprintf(out, "Profile %q: skipped, topic does not match %s\n",
+				p.Name, strings.Join(p.TopicPaths, ", "))
+			continue
+		}
+		matched = true
+
+		fmt.Fprintf(out, "Profile %q: topic matches %q\n", p.Name, filter)
+		points, err := msg2dbentry(p, msg, time.Now(), func(format string, args ...interface{}) {
+			fmt.Fprintf(out, "  "+format+"\n", args...)
+		})
+		if err != nil {
+			fmt.Fprintf(out, "  error: %v\n", err)
+			continue
+		}
+		if len(points) == 0 {
+			fmt.Fprintf(out, "  no points created\n")
+		}
+		for _, point := range points {
+			fmt.Fprintf(out, "  point: measurement %q, tags %v, fields %v, time %v\n",
+				point.Measurement, point.Tags, point.Fields,
+				point.Time.Format(time.RFC3339Nano))
+		}
+	}
+
+	if !matched {
+		return fmt.Errorf("no profile subscribed to topic %q", topic)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TestSuite is a list of messages together with the points expected
+// for them.
+type TestSuite struct {
+	Cases []TestCase `yaml:"cases"`
+}
+
+// TestCase is a single message. Either Expect contains the expected
+// points or Dropped is set, if the message should not create any
+// point.
+type TestCase struct {
+	Name     string          `yaml:"name,omitempty"`
+	Topic    string          `yaml:"topic"`
+	Payload  string          `yaml:"payload"`
+	Retained bool            `yaml:"retained,omitempty"`
+	Dropped  bool            `yaml:"dropped,omitempty"`
+	Expect   []ExpectedPoint `yaml:"expect,omitempty"`
+	// UserProperties are the MQTT v5 user properties of the message
+	UserProperties map[string]string `yaml:"user_properties,omitempty"`
+	// ContentType is the MQTT v5 content type of the message
+	ContentType string `yaml:"content_type,omitempty"`
+}
+
+// ExpectedPoint is a point expected for a message. Tags and fields
+// must match exactly, the time is only compared if set.
+type ExpectedPoint struct {
+	Measurement string                 `yaml:"measurement"`
+	Tags        map[string]string      `yaml:"tags,omitempty"`
+	Fields      map[string]interface{} `yaml:"fields"`
+	Time        *time.Time             `yaml:"time,omitempty"`
+}
+
+// convertMessage converts the message with every profile subscribed
+// to the topic.
+func convertMessage(profiles []*ProfileType, msg *message, received time.Time) ([]*Point, error) {
+	var result []*Point
+
+	for _, p := range profiles {
+		for _, f := range p.TopicPaths {
+			if topicMatches(f, msg.Topic()) {
+				points, err := msg2dbentry(p, msg, received, nil)
+				if err != nil {
+					return nil, fmt.Errorf("profile %q: %v", p.Name, err)
+				}
+				result = append(result, points...)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// formatPoint returns a string representation of a point, which is
+// used to compare it with the expected point. Values are compared
+// by their string representation, so that 20 matches 20.0.
+func formatPoint(measurement string, tags map[string]string, fields map[string]interface{}, t *time.Time) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "measurement %q, tags %v, fields {", measurement, tags)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, "%s:%v", k, fields[k])
+	}
+	b.WriteString("}")
+	if t != nil {
+		fmt.Fprintf(&b, ", time %s", t.UTC().Format(time.RFC3339Nano))
+	}
+	return b.String()
+}
+
+// runTestCase returns the differences between the expected and the
+// created points, "-" for missing and "+" for unexpected points.
+func runTestCase(profiles []*ProfileType, tc *TestCase) ([]string, error) {
+	msg := &message{topic: tc.Topic, payload: []byte(tc.Payload), retained: tc.Retained,
+		properties: userPropertiesFromMap(tc.UserProperties)}
+	if len(tc.ContentType) > 0 {
+		if msg.properties == nil {
+			msg.properties = &messageProperties{}
+		}
+		msg.properties.ContentType = tc.ContentType
+	}
+
+	points, err := convertMessage(profiles, msg, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// the time is only compared if all expected points contain it
+	compareTime := len(tc.Expect) > 0
+	for i := range tc.Expect {
+		if tc.Expect[i].Time == nil {
+			compareTime = false
+		}
+	}
+
+	var expected, got []string
+	for _, e := range tc.Expect {
+		expected = append(expected, formatPoint(e.Measurement, e.Tags, e.Fields, e.Time))
+	}
+	for _, p := range points {
+		var t *time.Time
+		if compareTime {
+			t = &p.Time
+		}
+		got = append(got, formatPoint(p.Measurement, p.Tags, p.Fields, t))
+	}
+
+	var diff []string
+	for _, e := range expected {
+		found := false
+		for i, g := range got {
+			if g == e {
+				got = append(got[:i], got[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, "- "+e)
+		}
+	}
+	for _, g := range got {
+		diff = append(diff, "+ "+g)
+	}
+	return diff, nil
+}
+
+// RunTestSuite runs all test cases and writes the result of every case
+// to out. The number of failed cases is returned.
+func RunTestSuite(config *ConfigType, suite *TestSuite, out io.Writer) (int, error) {
+	profiles, errs := setupProfiles(config)
+	if len(errs) > 0 {
+		return 0, errs[0]
+	}
+
+	failed := 0
+	for i := range suite.Cases {
+		tc := &suite.Cases[i]
+
+		name := tc.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("case %d (%s)", i+1, tc.Topic)
+		}
+		if tc.Dropped && len(tc.Expect) > 0 {
+			fmt.Fprintf(out, "FAIL %s: dropped and expect cannot be used together\n", name)
+			failed++
+			continue
+		}
+		if !tc.Dropped && len(tc.Expect) == 0 {
+			fmt.Fprintf(out, "FAIL %s: neither dropped nor expect specified\n", name)
+			failed++
+			continue
+		}
+
+		diff, err := runTestCase(profiles, tc)
+		if err != nil {
+			fmt.Fprintf(out, "FAIL %s: %v\n", name, err)
+			failed++
+			continue
+		}
+		if len(diff) > 0 {
+			fmt.Fprintf(out, "FAIL %s\n", name)
+			for _, d := range diff {
+				fmt.Fprintf(out, "  %s\n", d)
+			}
+			failed++
+			continue
+		}
+		if !Quiet {
+			fmt.Fprintf(out, "ok   %s\n", name)
+		}
+	}
+	return failed, nil
+}
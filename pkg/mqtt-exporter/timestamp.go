@@ -0,0 +1,158 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	timestampUnix    = "unix"
+	timestampUnixMs  = "unix_ms"
+	timestampUnixUs  = "unix_us"
+	timestampUnixNs  = "unix_ns"
+	timestampRFC3339 = "rfc3339"
+
+	retainedProcess = "process"
+	retainedSkip    = "skip"
+	retainedFlag    = "flag"
+	retainedTag     = "retained"
+)
+
+// TimestampConfig describes where the timestamp of a metric can be
+// found. One of Path, TopicElement and UserProperty must be set.
+type TimestampConfig struct {
+	// Path is the path of the timestamp inside the JSON payload,
+	// e.g. "params.ts"
+	Path string `yaml:"path,omitempty"`
+	// TopicElement is the index of the topic level containing the
+	// timestamp, negative values count from the end
+	TopicElement *int `yaml:"topic_element,omitempty"`
+	// UserProperty is the name of the MQTT v5 user property
+	// containing the timestamp
+	UserProperty string `yaml:"user_property,omitempty"`
+	// Format is one of unix, unix_ms, unix_us, unix_ns, rfc3339 or
+	// a Go time layout. If empty, numbers are interpreted as unix
+	// seconds and strings as RFC3339.
+	Format string `yaml:"format,omitempty"`
+
+	selector *selector
+}
+
+func (tc *TimestampConfig) compile() error {
+	if tc.TopicElement == nil && len(tc.Path) == 0 && len(tc.UserProperty) == 0 {
+		return fmt.Errorf("none of path, topic_element and user_property specified")
+	}
+	if len(tc.Path) > 0 {
+		var err error
+
+		tc.selector, err = parseSelector(tc.Path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseUnix converts a number in the given unit into a time.
+func parseUnix(value interface{}, unit time.Duration) (time.Time, error) {
+	switch v := value.(type) {
+	case float64:
+		// float64 is not precise enough for nanoseconds,
+		// so round the fraction to microseconds
+		sec, frac := math.Modf(v * float64(unit) / float64(time.Second))
+		return time.Unix(int64(sec), int64(math.Round(frac*1e6))*1000), nil
+	case string:
+		v = strings.TrimSpace(v)
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(0, 0).Add(time.Duration(i) * unit), nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cannot convert '%s' to a number: %v", v, err)
+		}
+		return parseUnix(f, unit)
+	}
+	return time.Time{}, fmt.Errorf("unsupported timestamp '%v'", value)
+}
+
+// parseTimestamp converts value according to format into a time.
+func parseTimestamp(value interface{}, format string) (time.Time, error) {
+	switch format {
+	case "":
+		if s, ok := value.(string); ok {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err != nil {
+				return time.Parse(time.RFC3339Nano, s)
+			}
+		}
+		return parseUnix(value, time.Second)
+	case timestampUnix:
+		return parseUnix(value, time.Second)
+	case timestampUnixMs:
+		return parseUnix(value, time.Millisecond)
+	case timestampUnixUs:
+		return parseUnix(value, time.Microsecond)
+	case timestampUnixNs:
+		return parseUnix(value, time.Nanosecond)
+	case timestampRFC3339:
+		return time.Parse(time.RFC3339Nano, fmt.Sprintf("%v", value))
+	default:
+		return time.Parse(format, fmt.Sprintf("%v", value))
+	}
+}
+
+// timestamp extracts the timestamp from the topic, the user
+// properties or the decoded JSON payload of a message.
+func (tc *TimestampConfig) timestamp(msg mqtt.Message, doc interface{}) (time.Time, error) {
+	var value interface{}
+
+	if tc.TopicElement != nil {
+		topic := msg.Topic()
+		elements := strings.Split(topic, "/")
+		i := *tc.TopicElement
+		if i < 0 {
+			i = len(elements) + i
+		}
+		if i < 0 || i >= len(elements) {
+			return time.Time{}, fmt.Errorf("topic %q has no element %d",
+				topic, *tc.TopicElement)
+		}
+		value = elements[i]
+	} else if len(tc.UserProperty) > 0 {
+		v, ok := messagePropertiesOf(msg).userProperty(tc.UserProperty)
+		if !ok {
+			return time.Time{}, fmt.Errorf("user property %q not found", tc.UserProperty)
+		}
+		value = v
+	} else {
+		found := tc.selector.find(doc)
+		if len(found) == 0 {
+			return time.Time{}, fmt.Errorf("%q not found", tc.Path)
+		}
+		value = found[0].Value
+		if n, ok := value.(json.Number); ok {
+			value = n.String()
+		}
+	}
+
+	return parseTimestamp(value, tc.Format)
+}
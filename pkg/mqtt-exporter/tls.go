@@ -0,0 +1,226 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/thkukuk/mqtt-exporter/pkg/logger"
+)
+
+// TLSConfig contains the settings for TLS connections. The files
+// are read again if they change, so that renewed certificates are
+// used without restart.
+type TLSConfig struct {
+	// CAFile contains the PEM encoded CA certificates to verify
+	// the server, if not set the system CAs are used
+	CAFile string `yaml:"ca_file,omitempty"`
+	// CertFile and KeyFile contain the client certificate
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+	// ServerName overrides the host name used to verify the
+	// server certificate
+	ServerName string `yaml:"server_name,omitempty"`
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3
+	MinVersion         string `yaml:"min_version,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsLoader creates the tls.Config and creates it again, if one of
+// the files changed.
+type tlsLoader struct {
+	mutex     sync.Mutex
+	config    TLSConfig
+	modTimes  map[string]time.Time
+	tlsConfig *tls.Config
+}
+
+// validateTLS checks the TLS settings and if the files can be loaded.
+func validateTLS(prefix string, config *TLSConfig) []error {
+	var errs []error
+
+	if config == nil {
+		return nil
+	}
+	if len(config.MinVersion) > 0 {
+		if _, ok := tlsVersions[config.MinVersion]; !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown min_version %q, valid are 1.0, 1.1, 1.2 and 1.3",
+				prefix, config.MinVersion))
+		}
+	}
+	if (len(config.CertFile) > 0) != (len(config.KeyFile) > 0) {
+		errs = append(errs, fmt.Errorf("%s: cert_file and key_file must be specified together", prefix))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if _, err := loadTLSConfig(config); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %v", prefix, err))
+	}
+	return errs
+}
+
+// loadTLSConfig reads the files and creates the tls.Config.
+func loadTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if len(config.MinVersion) > 0 {
+		tlsConfig.MinVersion = tlsVersions[config.MinVersion]
+	}
+
+	if len(config.CAFile) > 0 {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(config.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newTLSLoader loads the files, config must be valid.
+func newTLSLoader(config *TLSConfig) (*tlsLoader, error) {
+	l := &tlsLoader{config: *config}
+
+	var err error
+	l.modTimes = l.stat()
+	l.tlsConfig, err = loadTLSConfig(&l.config)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// stat returns the modification times of all files.
+func (l *tlsLoader) stat() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{l.config.CAFile, l.config.CertFile, l.config.KeyFile} {
+		if len(file) == 0 {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil {
+			modTimes[file] = fi.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// get returns the current tls.Config. If a file changed, the files
+// are loaded again. If this fails, the old configuration is kept.
+func (l *tlsLoader) get() *tls.Config {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	modTimes := l.stat()
+	changed := false
+	for file, t := range modTimes {
+		if !t.Equal(l.modTimes[file]) {
+			changed = true
+		}
+	}
+	if changed {
+		tlsConfig, err := loadTLSConfig(&l.config)
+		if err != nil {
+			log.Errorf("Cannot reload TLS files, keeping the old ones: %v", err)
+		} else {
+			if !Quiet {
+				log.Info("TLS files changed, reloaded")
+			}
+			l.tlsConfig = tlsConfig
+			l.modTimes = modTimes
+		}
+	}
+	return l.tlsConfig.Clone()
+}
+
+// dynamicConfig returns a tls.Config, which uses the current files
+// for every handshake. This is needed if the tls.Config cannot be
+// replaced, like for http.Transport. The server certificate is
+// verified like crypto/tls does it, but with the current CAs. host is
+// the host name or IP address of the server, the certificate must be
+// valid for it or for server_name, if set.
+func (l *tlsLoader) dynamicConfig(host string) *tls.Config {
+	current := l.get()
+
+	// crypto/tls does not send SNI for IP addresses, so the name
+	// of the connection state cannot be used for the verification
+	expected := host
+	if len(l.config.ServerName) > 0 {
+		expected = l.config.ServerName
+	}
+
+	config := &tls.Config{
+		ServerName: current.ServerName,
+		MinVersion: current.MinVersion,
+		// verified by VerifyConnection
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			current := l.get()
+			if len(current.Certificates) == 0 {
+				return &tls.Certificate{}, nil
+			}
+			return &current.Certificates[0], nil
+		},
+	}
+	if l.config.InsecureSkipVerify {
+		return config
+	}
+
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no server certificate")
+		}
+		if len(expected) == 0 {
+			return fmt.Errorf("no host name to verify the server certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         l.get().RootCAs,
+			DNSName:       expected,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return config
+}
@@ -0,0 +1,255 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// TransformConfig is one step of the transformation pipeline of a
+// metric. Every step must contain exactly one operation.
+type TransformConfig struct {
+	Multiply *float64     `yaml:"multiply,omitempty"`
+	Offset   *float64     `yaml:"offset,omitempty"`
+	Round    *int         `yaml:"round,omitempty"`
+	Clamp    *ClampConfig `yaml:"clamp,omitempty"`
+	Expr     string       `yaml:"expr,omitempty"`
+	Convert  string       `yaml:"convert,omitempty"`
+
+	expr      *expression
+	selectors map[string]*selector
+	from      *unitType
+	to        *unitType
+}
+
+type ClampConfig struct {
+	Min *float64 `yaml:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty"`
+}
+
+// unitType describes a unit by the conversion into the base unit of
+// its quantity: base = value * factor + offset
+type unitType struct {
+	quantity string
+	factor   float64
+	offset   float64
+}
+
+var units = map[string]unitType{
+	"C":           {"temperature", 1, 0},
+	"°C":          {"temperature", 1, 0},
+	"degC":        {"temperature", 1, 0},
+	"F":           {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"°F":          {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"degF":        {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"K":           {"temperature", 1, -273.15},
+	"Wh":          {"energy", 1, 0},
+	"kWh":         {"energy", 1000, 0},
+	"MWh":         {"energy", 1000000, 0},
+	"Wmin":        {"energy", 1.0 / 60.0, 0},
+	"Watt/Minute": {"energy", 1.0 / 60.0, 0},
+	"J":           {"energy", 1.0 / 3600.0, 0},
+	"kJ":          {"energy", 1000.0 / 3600.0, 0},
+	"W":           {"power", 1, 0},
+	"Watt":        {"power", 1, 0},
+	"mW":          {"power", 0.001, 0},
+	"kW":          {"power", 1000, 0},
+	"V":           {"voltage", 1, 0},
+	"Volt":        {"voltage", 1, 0},
+	"mV":          {"voltage", 0.001, 0},
+	"kV":          {"voltage", 1000, 0},
+	"A":           {"current", 1, 0},
+	"mA":          {"current", 0.001, 0},
+	"Pa":          {"pressure", 1, 0},
+	"hPa":         {"pressure", 100, 0},
+	"kPa":         {"pressure", 1000, 0},
+	"mbar":        {"pressure", 100, 0},
+	"bar":         {"pressure", 100000, 0},
+	"psi":         {"pressure", 6894.757293168, 0},
+	"mm":          {"length", 0.001, 0},
+	"cm":          {"length", 0.01, 0},
+	"m":           {"length", 1, 0},
+	"km":          {"length", 1000, 0},
+	"m/s":         {"speed", 1, 0},
+	"km/h":        {"speed", 1 / 3.6, 0},
+	"mph":         {"speed", 0.44704, 0},
+}
+
+func (t *TransformConfig) operations() int {
+	n := 0
+	if t.Multiply != nil {
+		n++
+	}
+	if t.Offset != nil {
+		n++
+	}
+	if t.Round != nil {
+		n++
+	}
+	if t.Clamp != nil {
+		n++
+	}
+	if len(t.Expr) > 0 {
+		n++
+	}
+	if len(t.Convert) > 0 {
+		n++
+	}
+	return n
+}
+
+// compile checks the transformation step. unit is the unit of the
+// value before this step, the unit after this step is returned.
+func (t *TransformConfig) compile(unit string) (string, error) {
+	if t.operations() != 1 {
+		return unit, fmt.Errorf("transform needs exactly one operation")
+	}
+
+	if t.Clamp != nil && t.Clamp.Min != nil && t.Clamp.Max != nil &&
+		*t.Clamp.Min > *t.Clamp.Max {
+		return unit, fmt.Errorf("clamp: min %v is larger than max %v",
+			*t.Clamp.Min, *t.Clamp.Max)
+	}
+
+	if len(t.Expr) > 0 {
+		var err error
+
+		t.expr, err = parseExpression(t.Expr)
+		if err != nil {
+			return unit, fmt.Errorf("expr %q: %v", t.Expr, err)
+		}
+		t.selectors = make(map[string]*selector)
+		for _, v := range t.expr.variables {
+			if v == exprValueVariable {
+				continue
+			}
+			if t.selectors[v], err = parseSelector(v); err != nil {
+				return unit, fmt.Errorf("expr %q: %v", t.Expr, err)
+			}
+		}
+	}
+
+	if len(t.Convert) > 0 {
+		from, ok := units[unit]
+		if !ok {
+			return unit, fmt.Errorf("cannot convert from unknown unit %q", unit)
+		}
+		to, ok := units[t.Convert]
+		if !ok {
+			return unit, fmt.Errorf("cannot convert to unknown unit %q", t.Convert)
+		}
+		if from.quantity != to.quantity {
+			return unit, fmt.Errorf("cannot convert %s (%s) to %s (%s)",
+				unit, from.quantity, t.Convert, to.quantity)
+		}
+		t.from = &from
+		t.to = &to
+		return t.Convert, nil
+	}
+	return unit, nil
+}
+
+// apply runs the transformation step on value. doc is the decoded JSON
+// payload, which is used to resolve variables of expressions.
+func (t *TransformConfig) apply(value float64, doc interface{}) (float64, error) {
+	switch {
+	case t.Multiply != nil:
+		return value * *t.Multiply, nil
+	case t.Offset != nil:
+		return value + *t.Offset, nil
+	case t.Round != nil:
+		p := math.Pow(10, float64(*t.Round))
+		return math.Round(value*p) / p, nil
+	case t.Clamp != nil:
+		if t.Clamp.Min != nil && value < *t.Clamp.Min {
+			value = *t.Clamp.Min
+		}
+		if t.Clamp.Max != nil && value > *t.Clamp.Max {
+			value = *t.Clamp.Max
+		}
+		return value, nil
+	case t.expr != nil:
+		return t.expr.eval(func(name string) (float64, error) {
+			if name == exprValueVariable {
+				return value, nil
+			}
+			found := t.selectors[name].find(doc)
+			if len(found) == 0 {
+				return 0, fmt.Errorf("%q not found", name)
+			}
+			f, err := strconv.ParseFloat(jsonString(found[0].Value), 64)
+			if err != nil {
+				return 0, fmt.Errorf("%q: %v", name, err)
+			}
+			return f, nil
+		})
+	case t.to != nil:
+		base := value*t.from.factor + t.from.offset
+		return (base - t.to.offset) / t.to.factor, nil
+	}
+	return value, nil
+}
+
+// numericValue converts a value of the type conversion into float64
+func numericValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, fmt.Errorf("'%v' is not a number", value)
+}
+
+// transformValue runs the transformation pipeline of the metric and
+// converts the result back into the type of the metric.
+func transformValue(metric *MetricsType, value interface{}, doc interface{}) (interface{}, error) {
+	if len(metric.Transform) == 0 || value == nil {
+		return value, nil
+	}
+
+	f, err := numericValue(value)
+	if err != nil {
+		return nil, err
+	}
+	for i := range metric.Transform {
+		if f, err = metric.Transform[i].apply(f, doc); err != nil {
+			return nil, fmt.Errorf("transform %d: %v", i+1, err)
+		}
+	}
+
+	switch value.(type) {
+	case int64:
+		return int64(math.Round(f)), nil
+	case int:
+		return int64(math.Round(f)), nil
+	case uint64:
+		// -0.4 is rounded to 0 and still fine
+		if math.Round(f) < 0 {
+			return nil, fmt.Errorf("%v is negative", f)
+		}
+		return uint64(math.Round(f)), nil
+	}
+	return f, nil
+}
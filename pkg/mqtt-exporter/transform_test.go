@@ -0,0 +1,254 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestConvertUnits(t *testing.T) {
+	tests := []struct {
+		from  string
+		to    string
+		value float64
+		want  float64
+	}{
+		{"C", "F", 100, 212},
+		{"C", "F", -40, -40},
+		{"F", "C", 32, 0},
+		{"°F", "°C", 212, 100},
+		{"degF", "degC", 50, 10},
+		{"K", "C", 0, -273.15},
+		{"C", "K", 0, 273.15},
+		{"F", "K", 32, 273.15},
+		{"Wh", "kWh", 1500, 1.5},
+		{"kWh", "Wh", 1.5, 1500},
+		{"MWh", "kWh", 1, 1000},
+		{"Wmin", "Wh", 60, 1},
+		{"Watt/Minute", "kWh", 60000, 1},
+		{"J", "Wh", 3600, 1},
+		{"kJ", "Wh", 3.6, 1},
+		{"W", "kW", 1500, 1.5},
+		{"Watt", "W", 7, 7},
+		{"mW", "W", 500, 0.5},
+		{"kV", "V", 1, 1000},
+		{"mV", "Volt", 230000, 230},
+		{"mA", "A", 250, 0.25},
+		{"hPa", "bar", 1013, 1.013},
+		{"mbar", "hPa", 1, 1},
+		{"kPa", "Pa", 1, 1000},
+		{"psi", "kPa", 1, 6.894757293168},
+		{"mm", "cm", 10, 1},
+		{"km", "m", 1, 1000},
+		{"cm", "m", 150, 1.5},
+		{"km/h", "m/s", 36, 10},
+		{"m/s", "km/h", 1, 3.6},
+		{"mph", "km/h", 1, 1.609344},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			tc := TransformConfig{Convert: tt.to}
+			unit, err := tc.compile(tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unit != tt.to {
+				t.Errorf("unit = %q, want %q", unit, tt.to)
+			}
+			got, err := tc.apply(tt.value, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-9*math.Max(1, math.Abs(tt.want)) {
+				t.Errorf("%v %s = %v %s, want %v", tt.value, tt.from, got, tt.to, tt.want)
+			}
+		})
+	}
+}
+
+// TestConvertRoundTrip converts between all units of the same quantity
+// and back, so that every entry of the table is checked.
+func TestConvertRoundTrip(t *testing.T) {
+	for from, fu := range units {
+		for to, tu := range units {
+			if fu.quantity != tu.quantity {
+				continue
+			}
+			there := TransformConfig{Convert: to}
+			back := TransformConfig{Convert: from}
+			if _, err := there.compile(from); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := back.compile(to); err != nil {
+				t.Fatal(err)
+			}
+			v, _ := there.apply(12.5, nil)
+			v, _ = back.apply(v, nil)
+			if math.Abs(v-12.5) > 1e-9 {
+				t.Errorf("12.5 %s -> %s -> %s = %v", from, to, from, v)
+			}
+		}
+	}
+}
+
+func TestTransformCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		tc   TransformConfig
+		unit string
+		err  string
+	}{
+		{"none", TransformConfig{}, "", "exactly one operation"},
+		{"two", TransformConfig{Multiply: floatPtr(2), Offset: floatPtr(1)}, "", "exactly one operation"},
+		{"unknown from", TransformConfig{Convert: "C"}, "Kelvin", "unknown unit \"Kelvin\""},
+		{"unknown to", TransformConfig{Convert: "Kelvin"}, "C", "unknown unit \"Kelvin\""},
+		{"no unit", TransformConfig{Convert: "C"}, "", "unknown unit \"\""},
+		{"quantity", TransformConfig{Convert: "kWh"}, "W", "cannot convert W (power) to kWh (energy)"},
+		{"clamp", TransformConfig{Clamp: &ClampConfig{Min: floatPtr(10), Max: floatPtr(0)}}, "", "min 10 is larger than max 0"},
+		{"expr", TransformConfig{Expr: "value *"}, "", "unexpected end"},
+		{"expr path", TransformConfig{Expr: "value * a[x]"}, "", "invalid array index"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.tc.compile(tt.unit)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("compile() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTransformApply(t *testing.T) {
+	doc, err := parseJSON([]byte(`{"params": {"voltage": 230, "text": "n/a"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		tc    TransformConfig
+		value float64
+		want  float64
+		err   string
+	}{
+		{"multiply", TransformConfig{Multiply: floatPtr(0.1)}, 215, 21.5, ""},
+		{"offset", TransformConfig{Offset: floatPtr(-0.5)}, 21, 20.5, ""},
+		{"round", TransformConfig{Round: intPtr(1)}, 21.46, 21.5, ""},
+		{"round zero", TransformConfig{Round: intPtr(0)}, 2.5, 3, ""},
+		{"round half away from zero", TransformConfig{Round: intPtr(0)}, -2.5, -3, ""},
+		{"round negative digits", TransformConfig{Round: intPtr(-2)}, 1234, 1200, ""},
+		{"round integer", TransformConfig{Round: intPtr(2)}, 7, 7, ""},
+		{"clamp below", TransformConfig{Clamp: &ClampConfig{Min: floatPtr(0), Max: floatPtr(100)}}, -5, 0, ""},
+		{"clamp above", TransformConfig{Clamp: &ClampConfig{Min: floatPtr(0), Max: floatPtr(100)}}, 105, 100, ""},
+		{"clamp inside", TransformConfig{Clamp: &ClampConfig{Min: floatPtr(0), Max: floatPtr(100)}}, 50, 50, ""},
+		{"clamp at min", TransformConfig{Clamp: &ClampConfig{Min: floatPtr(0), Max: floatPtr(100)}}, 0, 0, ""},
+		{"clamp at max", TransformConfig{Clamp: &ClampConfig{Min: floatPtr(0), Max: floatPtr(100)}}, 100, 100, ""},
+		{"clamp min only", TransformConfig{Clamp: &ClampConfig{Min: floatPtr(0)}}, 1e9, 1e9, ""},
+		{"clamp max only", TransformConfig{Clamp: &ClampConfig{Max: floatPtr(0)}}, -1e9, -1e9, ""},
+		{"clamp equal", TransformConfig{Clamp: &ClampConfig{Min: floatPtr(5), Max: floatPtr(5)}}, 7, 5, ""},
+		{"expr", TransformConfig{Expr: "value * params.voltage"}, 2, 460, ""},
+		{"expr not found", TransformConfig{Expr: "value * params.current"}, 2, 0, `"params.current" not found`},
+		{"expr no number", TransformConfig{Expr: "value * params.text"}, 2, 0, `"params.text"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.tc.compile(""); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.tc.apply(tt.value, doc)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("apply(%v) error = %v, want %q", tt.value, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("apply(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform []TransformConfig
+		value     interface{}
+		want      string
+		err       string
+	}{
+		{"no transform", nil, "abc", "string abc", ""},
+		{"nil", []TransformConfig{{Multiply: floatPtr(2)}}, nil, "<nil> <nil>", ""},
+		{"float", []TransformConfig{{Multiply: floatPtr(2)}}, 1.25, "float64 2.5", ""},
+		{"string", []TransformConfig{{Offset: floatPtr(1)}}, " 20.5 ", "float64 21.5", ""},
+		{"int rounded", []TransformConfig{{Multiply: floatPtr(0.5)}}, int64(5), "int64 3", ""},
+		{"int negative rounded", []TransformConfig{{Multiply: floatPtr(0.5)}}, int64(-5), "int64 -3", ""},
+		{"uint rounded", []TransformConfig{{Multiply: floatPtr(0.5)}}, uint64(5), "uint64 3", ""},
+		{"uint almost zero", []TransformConfig{{Offset: floatPtr(-5.4)}}, uint64(5), "uint64 0", ""},
+		{"uint negative", []TransformConfig{{Offset: floatPtr(-6)}}, uint64(5), "", "is negative"},
+		{"pipeline", []TransformConfig{
+			{Convert: "C"},
+			{Round: intPtr(1)},
+			{Clamp: &ClampConfig{Max: floatPtr(30)}},
+		}, 70.0, "float64 21.1", ""},
+		{"no number", []TransformConfig{{Multiply: floatPtr(2)}}, "n/a", "", "invalid syntax"},
+		{"bool", []TransformConfig{{Multiply: floatPtr(2)}}, true, "", "is not a number"},
+		{"step error", []TransformConfig{{Offset: floatPtr(1)}, {Expr: "value / 0"}}, 1.0, "", "transform 2: division by zero"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MetricsType{Name: tt.name, Unit: "F", Transform: tt.transform}
+			unit := m.Unit
+			for i := range m.Transform {
+				var err error
+				if unit, err = m.Transform[i].compile(unit); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := transformValue(m, tt.value, nil)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("transformValue(%v) error = %v, want %q", tt.value, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := fmt.Sprintf("%T %v", got, got); s != tt.want {
+				t.Errorf("transformValue(%v) = %s, want %s", tt.value, s, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2023 Thorsten Kukuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttExporter
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// validateSinks checks the sink configuration without connecting
+// to the backends.
+func validateSinks(config *ConfigType) []error {
+	var errs []error
+
+	configs := sinkConfigs(config)
+	if len(configs) == 0 {
+		return []error{fmt.Errorf("No sink specified, need influxdb, prometheus or sinks")}
+	}
+
+	healthCheck := config.HealthCheckListener != nil && len(*config.HealthCheckListener) > 0
+	prometheusSinks := 0
+	bufferDirs := make(map[string]string)
+
+	for _, sc := range configs {
+		if sc.InfluxDB != nil && sc.Prometheus != nil {
+			errs = append(errs, fmt.Errorf("sink %q: only one of influxdb and prometheus allowed", sc.Name))
+		} else if sc.InfluxDB != nil {
+			if len(sc.InfluxDB.Server) == 0 {
+				errs = append(errs, fmt.Errorf("sink %q: no influxdb server specified", sc.Name))
+			}
+			switch sc.InfluxDB.Version {
+			case 0, influxDBVersion1, influxDBVersion2, influxDBVersion3:
+			default:
+				errs = append(errs, fmt.Errorf("sink %q: unknown influxdb version %d, valid are 1, 2 and 3", sc.Name, sc.InfluxDB.Version))
+			}
+			switch sc.InfluxDB.Consistency {
+			case "", "any", "one", "quorum", "all":
+			default:
+				errs = append(errs, fmt.Errorf("sink %q: unknown consistency %q, valid are any, one, quorum and all", sc.Name, sc.InfluxDB.Consistency))
+			}
+			if sc.InfluxDB.Version != influxDBVersion1 &&
+				(len(sc.InfluxDB.Username) > 0 || len(sc.InfluxDB.Password) > 0 ||
+					len(sc.InfluxDB.RetentionPolicy) > 0 || len(sc.InfluxDB.Consistency) > 0) {
+				errs = append(errs, fmt.Errorf("sink %q: username, password, retention_policy and consistency require version 1", sc.Name))
+			}
+			errs = append(errs, validateProvisioning(sc.Name, sc.InfluxDB)...)
+			errs = append(errs, validateTLS(fmt.Sprintf("sink %q: tls_config", sc.Name), sc.InfluxDB.TLSConfig)...)
+			if len(sc.InfluxDB.Proxy) > 0 {
+				if u, err := url.Parse(sc.InfluxDB.Proxy); err != nil || len(u.Host) == 0 {
+					errs = append(errs, fmt.Errorf("sink %q: invalid proxy %q", sc.Name, sc.InfluxDB.Proxy))
+				}
+			}
+			if sc.InfluxDB.Timeout < 0 {
+				errs = append(errs, fmt.Errorf("sink %q: invalid timeout %v", sc.Name, sc.InfluxDB.Timeout))
+			}
+			if _, ok := precisions[sc.InfluxDB.Precision]; !ok && len(sc.InfluxDB.Precision) > 0 {
+				errs = append(errs, fmt.Errorf("sink %q: unknown precision %q, valid are s, ms, us and ns", sc.Name, sc.InfluxDB.Precision))
+			}
+			if b := sc.InfluxDB.Buffer; b != nil {
+				if len(b.Directory) == 0 {
+					errs = append(errs, fmt.Errorf("sink %q: no buffer directory specified", sc.Name))
+				} else if other, ok := bufferDirs[filepath.Clean(b.Directory)]; ok {
+					errs = append(errs, fmt.Errorf("sink %q: buffer directory already used by sink %q", sc.Name, other))
+				} else {
+					bufferDirs[filepath.Clean(b.Directory)] = sc.Name
+				}
+				if len(b.MaxSize) > 0 {
+					if _, err := parseSize(b.MaxSize); err != nil {
+						errs = append(errs, fmt.Errorf("sink %q: buffer: %v", sc.Name, err))
+					}
+				}
+			}
+		} else if sc.Prometheus != nil {
+			prometheusSinks++
+			if len(sc.Prometheus.Listener) == 0 && !healthCheck {
+				errs = append(errs, fmt.Errorf("sink %q: neither prometheus listener nor health_check specified", sc.Name))
+			}
+		} else {
+			errs = append(errs, fmt.Errorf("sink %q: no backend specified", sc.Name))
+		}
+	}
+	if prometheusSinks > 1 {
+		errs = append(errs, fmt.Errorf("Only one prometheus sink allowed"))
+	}
+	return errs
+}
+
+// validateProvisioning checks the settings used to create the
+// database.
+func validateProvisioning(name string, config *InfluxDBConfig) []error {
+	var errs []error
+
+	if config.Retention != 0 && config.Retention < time.Hour {
+		errs = append(errs, fmt.Errorf("sink %q: retention must be at least 1h", name))
+	}
+	if config.ShardGroupDuration < 0 {
+		errs = append(errs, fmt.Errorf("sink %q: invalid shard_group_duration %v", name, config.ShardGroupDuration))
+	}
+	if config.Version == influxDBVersion3 &&
+		(config.Retention != 0 || config.ShardGroupDuration != 0 || len(config.Description) > 0) {
+		errs = append(errs, fmt.Errorf("sink %q: retention, shard_group_duration and description are not supported by version 3", name))
+	}
+
+	ds := config.Downsample
+	if ds == nil {
+		return errs
+	}
+	if config.Version == influxDBVersion1 || config.Version == influxDBVersion3 {
+		errs = append(errs, fmt.Errorf("sink %q: downsample requires version 2", name))
+	}
+	if len(ds.Bucket) == 0 {
+		errs = append(errs, fmt.Errorf("sink %q: downsample: no bucket specified", name))
+	} else if ds.Bucket == config.Database {
+		errs = append(errs, fmt.Errorf("sink %q: downsample: bucket must differ from database", name))
+	}
+	if ds.Retention != 0 && ds.Retention < time.Hour {
+		errs = append(errs, fmt.Errorf("sink %q: downsample: retention must be at least 1h", name))
+	}
+	if ds.Every != 0 && ds.Every < time.Minute {
+		errs = append(errs, fmt.Errorf("sink %q: downsample: every must be at least 1m", name))
+	}
+	if len(ds.Function) > 0 && !downsampleFunctions[ds.Function] {
+		errs = append(errs, fmt.Errorf("sink %q: downsample: unknown function %q, valid are mean, median, min, max, sum, count, first and last", name, ds.Function))
+	}
+	return errs
+}
+
+// validateMQTT checks the mqtt section and the profiles. The compiled
+// profiles are returned, too.
+func validateMQTT(config *ConfigType) ([]*ProfileType, []error) {
+	var errs []error
+
+	if config.MQTT == nil {
+		errs = append(errs, fmt.Errorf("No mqtt section specified"))
+	} else {
+		if len(config.MQTT.Broker) == 0 {
+			errs = append(errs, fmt.Errorf("mqtt: no broker specified"))
+		}
+		switch config.MQTT.Protocol {
+		case "", defMQTTProtocol, defMQTTSProtocol, "tcp", "ssl", "tls", "ws", "wss":
+		default:
+			errs = append(errs, fmt.Errorf("mqtt: unknown protocol %q", config.MQTT.Protocol))
+		}
+		if config.MQTT.TLS != nil {
+			switch config.MQTT.Protocol {
+			case defMQTTProtocol, "tcp", "ws":
+				errs = append(errs, fmt.Errorf("mqtt: tls requires protocol mqtts, ssl, tls or wss"))
+			}
+			errs = append(errs, validateTLS("mqtt: tls", config.MQTT.TLS)...)
+		}
+		switch config.MQTT.ProtocolVersion {
+		case 0, mqttVersion31, mqttVersion311, mqttVersion5:
+		default:
+			errs = append(errs, fmt.Errorf("mqtt: unknown protocol_version %d, valid are 3, 4 and 5", config.MQTT.ProtocolVersion))
+		}
+		if strings.ContainsAny(config.MQTT.SharedGroup, "/+#") {
+			errs = append(errs, fmt.Errorf("mqtt: shared_group %q must not contain '/', '+' or '#'", config.MQTT.SharedGroup))
+		}
+	}
+
+	profiles, profileErrs := setupProfiles(config)
+	errs = append(errs, profileErrs...)
+
+	// only MQTT v5 messages have properties
+	if config.MQTT != nil && config.MQTT.ProtocolVersion != mqttVersion5 {
+		for _, p := range profiles {
+			if usesUserProperties(p) {
+				errs = append(errs, fmt.Errorf("profile %q: user properties require protocol_version 5", p.Name))
+			}
+			if len(p.ContentTypeTag) > 0 {
+				errs = append(errs, fmt.Errorf("profile %q: content_type_tag requires protocol_version 5", p.Name))
+			}
+		}
+	}
+
+	return profiles, errs
+}
+
+// usesUserProperties reports whether the profile creates tags or
+// timestamps from user properties.
+func usesUserProperties(p *ProfileType) bool {
+	if len(p.UserPropertyTags) > 0 {
+		return true
+	}
+	for _, m := range p.Metrics {
+		if m.Timestamp != nil && len(m.Timestamp.UserProperty) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateConfig checks the configuration: required sections, regular
+// expressions, metric types and name collisions. All problems found
+// are returned.
+func ValidateConfig(config *ConfigType) []error {
+	profiles, errs := validateMQTT(config)
+	errs = append(errs, validateSinks(config)...)
+	errs = append(errs, validateDeadLetter(config, profiles)...)
+
+	return errs
+}